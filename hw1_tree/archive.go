@@ -0,0 +1,336 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var errIsDir = errors.New("is a directory")
+
+func isArchive(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// openSource returns the file system to walk for a directory or an archive
+// and the function to call when the walk is over.
+func openSource(name string) (fs.FS, func() error, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() || !isArchive(name) {
+		return os.DirFS(name), func() error { return nil }, nil
+	}
+	return openArchive(os.DirFS(filepath.Dir(name)), filepath.Base(name))
+}
+
+// inArchive reports whether fsys is the contents of an archive.
+func inArchive(fsys fs.FS) bool {
+	switch fsys.(type) {
+	case *zip.Reader, tarFS:
+		return true
+	}
+	return false
+}
+
+// openArchive opens an archive stored in fsys, which can be an archive too.
+func openArchive(fsys fs.FS, name string) (fs.FS, func() error, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lower := strings.ToLower(name)
+	if strings.HasSuffix(lower, ".zip") {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		ra, ok := file.(io.ReaderAt)
+		if !ok {
+			data, err := io.ReadAll(file)
+			if err != nil {
+				file.Close()
+				return nil, nil, err
+			}
+			ra = bytes.NewReader(data)
+		}
+		zr, err := zip.NewReader(ra, info.Size())
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return zr, file.Close, nil
+	}
+
+	// the contents are read by offsets, a compressed or nested tar is
+	// unpacked into a temporary file first
+	var ra io.ReaderAt
+	var size int64
+	done := file.Close
+	if f, ok := file.(interface {
+		io.ReaderAt
+		Stat() (fs.FileInfo, error)
+	}); ok && strings.HasSuffix(lower, ".tar") {
+		info, err := f.Stat()
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		ra, size = f, info.Size()
+	} else {
+		defer file.Close()
+		var r io.Reader = file
+		if !strings.HasSuffix(lower, ".tar") {
+			gz, err := gzip.NewReader(file)
+			if err != nil {
+				return nil, nil, err
+			}
+			defer gz.Close()
+			r = gz
+		}
+		tmp, err := os.CreateTemp("", "tree-*.tar")
+		if err != nil {
+			return nil, nil, err
+		}
+		done = func() error {
+			tmp.Close()
+			return os.Remove(tmp.Name())
+		}
+		if size, err = io.Copy(tmp, r); err != nil {
+			done()
+			return nil, nil, err
+		}
+		ra = tmp
+	}
+
+	t, err := readTar(ra, size)
+	if err != nil {
+		done()
+		return nil, nil, err
+	}
+	return t, done, nil
+}
+
+// walkArchive turns the node of an archive file into a folder with its
+// contents, if the archive is broken the file node is kept.
+func walkArchive(fsys fs.FS, name string, file *FSNode, rel string, depth int, opts *options) *FSNode {
+	archive, done, err := openArchive(fsys, name)
+	if err != nil {
+		file.Err = errText(err)
+		return file
+	}
+	defer done()
+
+	folder := newFolder(file.Name)
+	if err = walkFS(folder, archive, ".", rel, depth, nil, opts); err != nil {
+		folder.Err = errText(err)
+	}
+	return folder
+}
+
+// tarFS is an index of a tar file: the headers and where the contents of
+// every entry are in the file.
+type tarFS map[string]*tarEntry
+
+type tarEntry struct {
+	info     fs.FileInfo
+	link     string
+	children map[string]bool
+	entries  []fs.DirEntry
+	// data are the contents of a file, nil for a directory
+	data *io.SectionReader
+}
+
+// dirInfo describes a directory which is implied by the paths in the archive.
+type dirInfo string
+
+func (d dirInfo) Name() string       { return string(d) }
+func (d dirInfo) Size() int64        { return 0 }
+func (d dirInfo) Mode() fs.FileMode  { return fs.ModeDir | 0555 }
+func (d dirInfo) ModTime() time.Time { return time.Time{} }
+func (d dirInfo) IsDir() bool        { return true }
+func (d dirInfo) Sys() interface{}   { return nil }
+
+func readTar(ra io.ReaderAt, size int64) (tarFS, error) {
+	t := tarFS{".": {info: dirInfo("."), children: make(map[string]bool)}}
+	// tar skips the contents by Seek, after Next the reader is at the
+	// contents of the entry
+	r := io.NewSectionReader(ra, 0, size)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name == "" || !fs.ValidPath(name) {
+			continue
+		}
+		e := t.dir(path.Dir(name))
+		e.children[path.Base(name)] = true
+		if hdr.Typeflag == tar.TypeDir {
+			t.dir(name).info = hdr.FileInfo()
+			continue
+		}
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		data := io.NewSectionReader(ra, offset, hdr.Size)
+		if isSparse(hdr) {
+			// the contents have holes, they are not where the offset is
+			contents, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			data = io.NewSectionReader(bytes.NewReader(contents), 0, int64(len(contents)))
+		}
+		t[name] = &tarEntry{info: hdr.FileInfo(), link: hdr.Linkname, data: data}
+	}
+
+	for name, e := range t {
+		if !e.info.IsDir() {
+			continue
+		}
+		names := make([]string, 0, len(e.children))
+		for child := range e.children {
+			names = append(names, child)
+		}
+		sort.Strings(names)
+		for _, child := range names {
+			e.entries = append(e.entries, fs.FileInfoToDirEntry(t[path.Join(name, child)].info))
+		}
+		e.children = nil
+	}
+	return t, nil
+}
+
+func isSparse(hdr *tar.Header) bool {
+	if hdr.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range hdr.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// dir returns the entry of a directory creating it and its parents.
+func (t tarFS) dir(name string) *tarEntry {
+	if e, ok := t[name]; ok && e.info.IsDir() {
+		return e
+	}
+	e := &tarEntry{info: dirInfo(path.Base(name)), children: make(map[string]bool)}
+	t[name] = e
+	if name != "." {
+		t.dir(path.Dir(name)).children[path.Base(name)] = true
+	}
+	return e
+}
+
+func (t tarFS) entry(op, name string) (*tarEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	e, ok := t[name]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return e, nil
+}
+
+func (t tarFS) Open(name string) (fs.File, error) {
+	e, err := t.entry("open", name)
+	if err != nil {
+		return nil, err
+	}
+	f := &tarFile{tarEntry: e, name: name}
+	if e.data != nil {
+		// every file has its own position
+		f.data = io.NewSectionReader(e.data, 0, e.data.Size())
+	}
+	return f, nil
+}
+
+func (t tarFS) ReadLink(name string) (string, error) {
+	e, err := t.entry("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	if e.info.Mode()&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return e.link, nil
+}
+
+func (t tarFS) Lstat(name string) (fs.FileInfo, error) {
+	e, err := t.entry("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	return e.info, nil
+}
+
+type tarFile struct {
+	*tarEntry
+	name   string
+	offset int
+	data   *io.SectionReader
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *tarFile) Close() error               { return nil }
+
+func (f *tarFile) Read(p []byte) (int, error) {
+	if f.data == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errIsDir}
+	}
+	return f.data.Read(p)
+}
+
+// ReadAt lets a zip inside the tar be opened without reading it into memory.
+func (f *tarFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.data == nil {
+		return 0, &fs.PathError{Op: "read", Path: f.name, Err: errIsDir}
+	}
+	return f.data.ReadAt(p, off)
+}
+
+func (f *tarFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+	}
+	rest := f.entries[f.offset:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+	f.offset += len(rest)
+	return rest, nil
+}
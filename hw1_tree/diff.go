@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+)
+
+const (
+	statusAdded    = "+"
+	statusRemoved  = "-"
+	statusResized  = "~"
+	statusModified = "*"
+)
+
+// diffTree prints the merged tree of two directories or snapshots, each
+// node of the merged tree is marked with its status.
+func diffTree(out io.Writer, oldPath, newPath string, opts *options) error {
+	oldRoot, err := loadRoot(oldPath, opts)
+	if err != nil {
+		return err
+	}
+	newRoot, err := loadRoot(newPath, opts)
+	if err != nil {
+		return err
+	}
+	diffOpts := *opts
+	diffOpts.diff = true
+	return writeTree(out, diffTrees(oldRoot, newRoot, opts.hash), &diffOpts)
+}
+
+// loadRoot walks path if it is a directory or an archive and loads it as
+// a snapshot otherwise.
+func loadRoot(path string, opts *options) (*FSNode, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() || isArchive(path) {
+		return buildTree(path, opts)
+	}
+	return loadTreeFile(path)
+}
+
+// diffTrees merges two trees. Contents are compared only if compareHash is
+// set and both sides have a hash, e.g. snapshots written without --hash
+// can only be compared by size.
+func diffTrees(oldRoot, newRoot *FSNode, compareHash bool) *FSNode {
+	root := newFolder(newRoot.Name)
+	root.Kind, root.Link, root.Err = newRoot.Kind, newRoot.Link, newRoot.Err
+
+	for name, o := range oldRoot.Folders {
+		if n, ok := newRoot.Folders[name]; ok {
+			root.Folders[name] = diffTrees(o, n, compareHash)
+		} else {
+			root.Folders[name] = markTree(o, statusRemoved)
+		}
+	}
+	for name, n := range newRoot.Folders {
+		if _, ok := oldRoot.Folders[name]; !ok {
+			root.Folders[name] = markTree(n, statusAdded)
+		}
+	}
+
+	oldFiles := make(map[string]*FSNode, len(oldRoot.Files))
+	for _, o := range oldRoot.Files {
+		oldFiles[o.Name] = o
+	}
+	for _, n := range newRoot.Files {
+		f := *n
+		if o, ok := oldFiles[n.Name]; !ok {
+			f.Status = statusAdded
+		} else if o.Size != n.Size {
+			f.Status = statusResized
+			f.OldSize = o.Size
+		} else if compareHash && o.Hash != "" && n.Hash != "" && o.Hash != n.Hash {
+			f.Status = statusModified
+		}
+		delete(oldFiles, n.Name)
+		root.Files = append(root.Files, &f)
+	}
+	for _, o := range oldRoot.Files {
+		if _, ok := oldFiles[o.Name]; ok {
+			root.Files = append(root.Files, markTree(o, statusRemoved))
+		}
+	}
+
+	return root
+}
+
+// markTree copies the subtree with every node marked as status.
+func markTree(f *FSNode, status string) *FSNode {
+	if !f.IsDir {
+		file := *f
+		file.Status = status
+		return &file
+	}
+	root := newFolder(f.Name)
+	root.Size, root.Status = f.Size, status
+	root.Kind, root.Link, root.Err = f.Kind, f.Link, f.Err
+	for name, d := range f.Folders {
+		root.Folders[name] = markTree(d, status)
+	}
+	for _, file := range f.Files {
+		root.Files = append(root.Files, markTree(file, status))
+	}
+	return root
+}
+
+// hashFile returns sha256 of the first limit bytes of the file, a negative
+// limit means the whole file.
+func hashFile(fsys fs.FS, name string, limit int64) (string, error) {
+	file, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if limit >= 0 {
+		r = io.LimitReader(file, limit)
+	}
+	h := sha256.New()
+	if _, err = io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// partialSize is how much of a file is hashed before hashing all of it.
+const partialSize = 4096
+
+type dupeFile struct {
+	node *FSNode
+	path string
+	key  string
+}
+
+type dupeGroup struct {
+	size  int64
+	files []*dupeFile
+}
+
+func (g *dupeGroup) reclaimable() int64 {
+	return g.size * int64(len(g.files)-1)
+}
+
+// findDupes groups identical files: by size first, then by the hash of
+// the first partialSize bytes and then by the hash of the whole file.
+// Files which can't be read are left out.
+func findDupes(root *FSNode, opts *options) []*dupeGroup {
+	var files []*dupeFile
+	collectFiles(root, root.Name, &files)
+
+	workers := opts.workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	groups := groupFiles(files, func(f *dupeFile) string {
+		return fmt.Sprint(f.node.Size)
+	})
+	groups = regroup(groups, workers, func(f *dupeFile) (string, error) {
+		return hashNode(f.node, partialSize)
+	})
+	groups = regroup(groups, workers, func(f *dupeFile) (string, error) {
+		if f.node.Size <= partialSize {
+			return f.key, nil
+		}
+		if f.node.Hash != "" {
+			return f.node.Hash, nil
+		}
+		return hashNode(f.node, -1)
+	})
+
+	result := make([]*dupeGroup, 0, len(groups))
+	for _, files := range groups {
+		sort.Slice(files, func(i, j int) bool {
+			return files[i].path < files[j].path
+		})
+		result = append(result, &dupeGroup{size: files[0].node.Size, files: files})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].reclaimable() != result[j].reclaimable() {
+			return result[i].reclaimable() > result[j].reclaimable()
+		}
+		return result[i].files[0].path < result[j].files[0].path
+	})
+	return result
+}
+
+func collectFiles(f *FSNode, dir string, files *[]*dupeFile) {
+	for _, file := range f.Files {
+		if file.Size > 0 && file.Kind == "" && file.Err == "" && (file.fsys != nil || file.Hash != "") {
+			*files = append(*files, &dupeFile{node: file, path: filepath.Join(dir, file.Name)})
+		}
+	}
+	for _, folder := range f.Folders {
+		collectFiles(folder, filepath.Join(dir, folder.Name), files)
+	}
+}
+
+// groupFiles splits files by key and drops the groups of a single file.
+func groupFiles(files []*dupeFile, key func(*dupeFile) string) [][]*dupeFile {
+	byKey := make(map[string][]*dupeFile)
+	for _, f := range files {
+		k := key(f)
+		byKey[k] = append(byKey[k], f)
+	}
+	groups := make([][]*dupeFile, 0, len(byKey))
+	for _, g := range byKey {
+		if len(g) > 1 {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// regroup computes the key of every file with a pool of workers and splits
+// each group by it.
+func regroup(groups [][]*dupeFile, workers int, key func(*dupeFile) (string, error)) [][]*dupeFile {
+	in := make(chan *dupeFile)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range in {
+				k, err := key(f)
+				if err != nil {
+					k = ""
+				}
+				f.key = k
+			}
+		}()
+	}
+	for _, g := range groups {
+		for _, f := range g {
+			in <- f
+		}
+	}
+	close(in)
+	wg.Wait()
+
+	var result [][]*dupeFile
+	for _, g := range groups {
+		var readable []*dupeFile
+		for _, f := range g {
+			if f.key != "" {
+				readable = append(readable, f)
+			}
+		}
+		result = append(result, groupFiles(readable, func(f *dupeFile) string {
+			return f.key
+		})...)
+	}
+	return result
+}
+
+// hashNode hashes the first limit bytes of the file, a negative limit
+// means the whole file. A loaded snapshot has no files to read, only the
+// hashes stored in it, and an entry of a closed archive keeps its partial
+// hash too.
+func hashNode(f *FSNode, limit int64) (string, error) {
+	if f.fsys == nil && limit >= 0 && f.partialHash != "" {
+		return f.partialHash, nil
+	}
+	if f.fsys == nil {
+		if f.Hash == "" {
+			return "", fs.ErrNotExist
+		}
+		return f.Hash, nil
+	}
+	return hashFile(f.fsys, f.fsPath, limit)
+}
+
+// markDupes annotates the files of every group with its number.
+func markDupes(groups []*dupeGroup) {
+	for i, g := range groups {
+		for _, f := range g.files {
+			f.node.Dupe = i + 1
+		}
+	}
+}
+
+func printDupes(out io.Writer, groups []*dupeGroup, opts *options) {
+	var total int64
+	for i, g := range groups {
+		total += g.reclaimable()
+		fmt.Fprintf(out, "#%d: %d files of %v, %v reclaimable\n",
+			i+1, len(g.files), formatSize(g.size, opts.units), formatSize(g.reclaimable(), opts.units))
+		for _, f := range g.files {
+			fmt.Fprintf(out, "\t%v\n", f.path)
+		}
+	}
+	fmt.Fprintf(out, "duplicate groups: %d, reclaimable: %v\n", len(groups), formatSize(total, opts.units))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"path"
+	"strings"
+)
+
+// pattern is a single .gitignore-like glob: "!" negates it, a trailing "/"
+// restricts it to directories and a "/" anywhere else anchors it to the
+// root of the walk instead of matching the base name at any level.
+type pattern struct {
+	glob     string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+func parsePattern(s string) (pattern, error) {
+	p := pattern{}
+	if strings.HasPrefix(s, "!") {
+		p.negate = true
+		s = s[1:]
+	}
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly = true
+		s = strings.TrimSuffix(s, "/")
+	}
+	if strings.Contains(s, "/") {
+		p.anchored = true
+		s = strings.TrimPrefix(s, "/")
+	}
+	if s == "" {
+		return p, path.ErrBadPattern
+	}
+	if _, err := path.Match(s, ""); err != nil {
+		return p, err
+	}
+	p.glob = s
+	return p, nil
+}
+
+func (p pattern) String() string {
+	s := p.glob
+	if p.anchored && !strings.Contains(s, "/") {
+		s = "/" + s
+	}
+	if p.dirOnly {
+		s += "/"
+	}
+	if p.negate {
+		s = "!" + s
+	}
+	return s
+}
+
+// matches reports whether rel (slash separated, relative to the walk root)
+// is matched by the glob, ignoring negation.
+func (p pattern) matches(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	name := rel
+	if !p.anchored {
+		name = path.Base(rel)
+	}
+	ok, _ := path.Match(p.glob, name)
+	return ok
+}
+
+// joinRel appends name to the slash separated path of its parent.
+func joinRel(base, name string) string {
+	if base == "" {
+		return name
+	}
+	return base + "/" + name
+}
+
+// patternList implements flag.Value so that --include/--exclude can be repeated.
+type patternList []pattern
+
+func (l *patternList) String() string {
+	if l == nil {
+		return ""
+	}
+	s := make([]string, 0, len(*l))
+	for _, p := range *l {
+		s = append(s, p.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *patternList) Set(v string) error {
+	p, err := parsePattern(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, p)
+	return nil
+}
+
+// match works like .gitignore: the last pattern that matches rel wins.
+func (l patternList) match(rel string, isDir bool) bool {
+	matched := false
+	for _, p := range l {
+		if p.matches(rel, isDir) {
+			matched = !p.negate
+		}
+	}
+	return matched
+}
+
+// skip reports whether the entry must be left out of the tree. Include
+// patterns only select files, directories are pruned by exclude and depth.
+func (o *options) skip(rel string, isDir bool, depth int) bool {
+	if o.maxDepth > 0 && depth > o.maxDepth {
+		return true
+	}
+	if o.exclude.match(rel, isDir) {
+		return true
+	}
+	if !isDir && len(o.include) > 0 && !o.include.match(rel, isDir) {
+		return true
+	}
+	return false
+}
+
+// descend reports whether the walker has to go below a directory at depth.
+func (o *options) descend(depth int) bool {
+	return o.maxDepth <= 0 || depth < o.maxDepth
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"unicode"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatXML  = "xml"
+)
+
+// nodeSnapshot is the serialized form of FSNode, children are kept in the
+// same order as in the text output.
+type nodeSnapshot struct {
+	XMLName  xml.Name        `json:"-" xml:"node"`
+	Name     string          `json:"name" xml:"name,attr"`
+	Size     int64           `json:"size" xml:"size,attr"`
+	IsDir    bool            `json:"isDir" xml:"isDir,attr"`
+	Hash     string          `json:"hash,omitempty" xml:"hash,attr,omitempty"`
+	Status   string          `json:"status,omitempty" xml:"status,attr,omitempty"`
+	OldSize  int64           `json:"oldSize,omitempty" xml:"oldSize,attr,omitempty"`
+	Kind     string          `json:"kind,omitempty" xml:"kind,attr,omitempty"`
+	Link     string          `json:"link,omitempty" xml:"link,attr,omitempty"`
+	Err      string          `json:"error,omitempty" xml:"error,attr,omitempty"`
+	Children []*nodeSnapshot `json:"children,omitempty" xml:"node"`
+}
+
+func newSnapshot(f *FSNode, opts *options) *nodeSnapshot {
+	s := &nodeSnapshot{
+		Name: f.Name, Size: f.Size, IsDir: f.IsDir, Hash: f.Hash, Status: f.Status,
+		OldSize: f.OldSize, Kind: f.Kind, Link: f.Link, Err: f.Err,
+	}
+	if !f.IsDir {
+		return s
+	}
+	for _, node := range f.children(opts) {
+		s.Children = append(s.Children, newSnapshot(node, opts))
+	}
+	return s
+}
+
+func (s *nodeSnapshot) node() *FSNode {
+	f := &FSNode{
+		Name: s.Name, Size: s.Size, IsDir: s.IsDir, Hash: s.Hash, Status: s.Status,
+		OldSize: s.OldSize, Kind: s.Kind, Link: s.Link, Err: s.Err,
+	}
+	if !s.IsDir {
+		return f
+	}
+	f.Files = []*FSNode{}
+	f.Folders = make(map[string]*FSNode)
+	for _, child := range s.Children {
+		node := child.node()
+		if node.IsDir {
+			f.Folders[node.Name] = node
+		} else {
+			f.Files = append(f.Files, node)
+		}
+	}
+	return f
+}
+
+func writeTree(out io.Writer, root *FSNode, opts *options) error {
+	switch {
+	case opts.diff && (opts.du || opts.sortBy == sortSize):
+		root.aggregateDiff()
+	case opts.du || opts.sortBy == sortSize:
+		root.aggregate()
+	}
+
+	format := opts.format
+	if format == "" {
+		format = formatText
+	}
+	if r, ok := renderers[format]; ok {
+		r.begin(out, root)
+		printTree(out, root, r, nil, opts)
+		r.end(out, root)
+		return nil
+	}
+
+	// a snapshot is read by programs and by --load, it keeps the files
+	// whether -f is given or not
+	snapshotOpts := *opts
+	snapshotOpts.printFiles = true
+	switch format {
+	case formatJSON:
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return enc.Encode(newSnapshot(root, &snapshotOpts))
+	case formatXML:
+		if _, err := io.WriteString(out, xml.Header); err != nil {
+			return err
+		}
+		enc := xml.NewEncoder(out)
+		enc.Indent("", "  ")
+		if err := enc.Encode(newSnapshot(root, &snapshotOpts)); err != nil {
+			return err
+		}
+		_, err := io.WriteString(out, "\n")
+		return err
+	}
+	return fmt.Errorf("unknown format %q", opts.format)
+}
+
+// loadTree reads a snapshot written by writeTree, the format is detected
+// by the first significant character.
+func loadTree(r io.Reader) (*FSNode, error) {
+	br := bufio.NewReader(r)
+	for {
+		c, _, err := br.ReadRune()
+		if err != nil {
+			return nil, fmt.Errorf("cant detect snapshot format: %v", err)
+		}
+		if unicode.IsSpace(c) {
+			continue
+		}
+		if err = br.UnreadRune(); err != nil {
+			return nil, err
+		}
+
+		s := &nodeSnapshot{}
+		switch c {
+		case '{':
+			err = json.NewDecoder(br).Decode(s)
+		case '<':
+			err = xml.NewDecoder(br).Decode(s)
+		default:
+			return nil, fmt.Errorf("unknown snapshot format")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !s.IsDir {
+			return nil, fmt.Errorf("snapshot root %q is not a directory", s.Name)
+		}
+		return s.node(), nil
+	}
+}
+
+func loadTreeFile(path string) (*FSNode, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return loadTree(file)
+}
@@ -1,108 +1,329 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
-	"path/filepath"
-	"sort"
+	"path"
 	"strings"
+	"time"
 )
 
+const usage = `usage go run main.go . [-f] [-L N] [--include PATTERN] [--exclude PATTERN] [--format text|ascii|markdown|html|json|xml] [--load SNAPSHOT]
+	go run main.go diff [--hash] OLD NEW, where OLD and NEW are directories or snapshots
+	go run main.go --watch [--summary] [--debounce D] [--poll D] .`
+
 func main() {
 	out := os.Stdout
-	if !(len(os.Args) == 2 || len(os.Args) == 3) {
-		panic("usage go run main.go . [-f]")
+	opts, paths, err := parseArgs(os.Args[1:])
+	switch {
+	case err != nil:
+		panic(err.Error() + "\n" + usage)
+	case len(paths) == 3 && paths[0] == "diff":
+		err = diffTree(out, paths[1], paths[2], opts)
+	case len(paths) == 1 && opts.watch:
+		err = watchTree(out, paths[0], opts, nil)
+	case len(paths) == 1 && opts.load == "":
+		err = dirTreeOptions(out, paths[0], opts)
+	case len(paths) == 0 && opts.load != "":
+		var root *FSNode
+		root, err = loadTreeFile(opts.load)
+		if err == nil {
+			err = printRoot(out, root, opts)
+		}
+	default:
+		panic(usage)
 	}
-	path := os.Args[1]
-	printFiles := len(os.Args) == 3 && os.Args[2] == "-f"
-	err := dirTree(out, path, printFiles)
 	if err != nil {
 		panic(err.Error())
 	}
 }
 
-func dirTree(out io.Writer, startPath string, printFiles bool) (err error) {
-	rootFolder := newFolder(startPath)
+type options struct {
+	printFiles bool
+	maxDepth   int
+	include    patternList
+	exclude    patternList
+	format     string
+	load       string
+	du         bool
+	units      string
+	sortBy     string
+	workers    int
+	hash       bool
+	follow     bool
+	archives   bool
+	dupes      bool
+	markDupes  bool
+	watch      bool
+	summary    bool
+	debounce   time.Duration
+	poll       time.Duration
+	// diff is set for the merged tree of diffTree
+	diff bool
+}
 
-	err = filepath.Walk(startPath, func(path string, info os.FileInfo, err error) error {
-		segments := strings.Split(path, string(filepath.Separator))
-		if info.IsDir() {
-			getFolder(rootFolder, segments)
+// parseArgs accepts flags both before and after the positional arguments,
+// so the old "main.go . -f" form keeps working.
+func parseArgs(args []string) (*options, []string, error) {
+	opts := &options{}
+	flags := flag.NewFlagSet("tree", flag.ContinueOnError)
+	flags.BoolVar(&opts.printFiles, "f", false, "print files")
+	flags.IntVar(&opts.maxDepth, "L", 0, "max depth of the tree, 0 - unlimited")
+	flags.Var(&opts.include, "include", "show only files matching the glob, can be repeated, ! negates")
+	flags.Var(&opts.exclude, "exclude", "skip files and directories matching the glob, can be repeated, ! negates")
+	flags.StringVar(&opts.format, "format", formatText, "output format: text, ascii, markdown, html, json or xml")
+	flags.StringVar(&opts.load, "load", "", "print a json or xml snapshot instead of walking a directory")
+	flags.BoolVar(&opts.du, "du", false, "show aggregated size and number of files and dirs for directories")
+	flags.StringVar(&opts.units, "units", unitsBytes, "size units: b or human")
+	flags.StringVar(&opts.sortBy, "sort", sortName, "order of siblings: name or size")
+	flags.IntVar(&opts.workers, "j", 0, "read directories with N goroutines, 0 - sequential walk")
+	flags.BoolVar(&opts.hash, "hash", false, "compute sha256 of files, diff compares contents")
+	flags.BoolVar(&opts.follow, "follow", false, "descend into symlinked directories")
+	flags.BoolVar(&opts.archives, "archives", false, "descend into zip and tar archives")
+	flags.BoolVar(&opts.dupes, "dupes", false, "print groups of identical files instead of the tree")
+	flags.BoolVar(&opts.markDupes, "mark-dupes", false, "annotate identical files in the tree")
+	flags.BoolVar(&opts.watch, "watch", false, "keep running and print the tree again when it changes")
+	flags.BoolVar(&opts.summary, "summary", false, "in watch mode print only the changes")
+	flags.DurationVar(&opts.debounce, "debounce", defaultDebounce, "in watch mode wait for changes to settle")
+	flags.DurationVar(&opts.poll, "poll", 0, "in watch mode poll with the interval instead of using inotify")
 
-		} else {
-			f := getFolder(rootFolder, segments[:len(segments)-1])
-			f.Files = append(f.Files, &FSNode{Name: info.Name(), Size: info.Size()})
+	var paths []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, nil, err
+		}
+		if flags.NArg() == 0 {
+			break
 		}
+		paths = append(paths, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
 
-		return err
-	})
+	if opts.units != unitsBytes && opts.units != unitsHuman {
+		return nil, nil, fmt.Errorf("unknown units %q", opts.units)
+	}
+	if opts.sortBy != sortName && opts.sortBy != sortSize {
+		return nil, nil, fmt.Errorf("unknown sort order %q", opts.sortBy)
+	}
+	if opts.markDupes && !opts.printFiles {
+		// duplicates are files, the tree would show none of them
+		return nil, nil, fmt.Errorf("--mark-dupes needs -f")
+	}
+	return opts, paths, nil
+}
 
-	printTree(out, rootFolder.Folders[startPath], "", printFiles)
+func dirTree(out io.Writer, startPath string, printFiles bool) error {
+	return dirTreeOptions(out, startPath, &options{printFiles: printFiles, units: unitsBytes, sortBy: sortName})
+}
 
-	return err
+func dirTreeOptions(out io.Writer, startPath string, opts *options) error {
+	root, err := buildTree(startPath, opts)
+	if err != nil {
+		return err
+	}
+	return printRoot(out, root, opts)
 }
 
-func printTree(out io.Writer, f *FSNode, prefix string, printFiles bool) {
-	fl := make([]*FSNode, 0, len(f.Folders)+len(f.Files))
-	for _, v := range f.Folders {
-		fl = append(fl, v)
+// printRoot writes the tree and the duplicates report if it was asked for.
+func printRoot(out io.Writer, root *FSNode, opts *options) error {
+	if !opts.dupes && !opts.markDupes {
+		return writeTree(out, root, opts)
 	}
 
-	if printFiles {
-		for _, v := range f.Files {
-			fl = append(fl, v)
+	groups := findDupes(root, opts)
+	if opts.markDupes {
+		markDupes(groups)
+		if err := writeTree(out, root, opts); err != nil {
+			return err
 		}
 	}
+	if opts.dupes {
+		printDupes(out, groups, opts)
+	}
+	return nil
+}
 
-	sort.Slice(fl, func(i, j int) bool {
-		return fl[i].Name < fl[j].Name
-	})
+func buildTree(startPath string, opts *options) (*FSNode, error) {
+	if opts.workers > 0 {
+		return scanTree(startPath, opts, opts.workers)
+	}
+	return walkTree(startPath, opts)
+}
 
-	var subPrefix string
+// walkTree applies the filters while walking, so pruned directories are
+// never read and never end up in the tree. startPath is a directory or
+// an archive.
+func walkTree(startPath string, opts *options) (*FSNode, error) {
+	fsys, done, err := openSource(startPath)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 
-	for i, node := range fl {
+	rootFolder := newFolder(startPath)
+	err = walkFS(rootFolder, fsys, ".", "", 0, nil, opts)
+	return rootFolder, err
+}
 
-		if i != len(fl)-1 {
-			subPrefix = fmt.Sprintf("%v├───", prefix)
-		} else {
-			subPrefix = fmt.Sprintf("%v└───", prefix)
+// walkFS walks dir of fsys into root, which is placed at rel and depth of
+// the whole tree. chain holds the directories above dir, it is only
+// needed to detect loops of followed symlinks.
+func walkFS(root *FSNode, fsys fs.FS, dir, rel string, depth int, chain []fs.FileInfo, opts *options) error {
+	dirs := make(map[string]fs.FileInfo)
+
+	return fs.WalkDir(fsys, dir, func(name string, d fs.DirEntry, err error) error {
+		if name == dir {
+			if err != nil && dir == "." {
+				return err
+			}
+			if err != nil {
+				root.Err = errText(err)
+			} else if opts.follow {
+				dirs[name], _ = d.Info()
+			}
+			return nil
 		}
-		fmt.Fprintf(out, "%v%v\n", subPrefix, node)
 
-		if i != len(fl)-1 {
-			subPrefix = strings.Replace(subPrefix, "├───", "│\t", -1)
-		} else {
-			subPrefix = strings.Replace(subPrefix, "└───", "\t", -1)
+		sub := name
+		if dir != "." {
+			sub = strings.TrimPrefix(name, dir+"/")
+		}
+		segments := strings.Split(sub, "/")
+		nodeDepth := depth + len(segments)
+		nodeRel := joinRel(rel, sub)
+		parent := getFolder(root, segments[:len(segments)-1])
+
+		info, infoErr := d.Info()
+		if infoErr != nil {
+			// the entry was listed but can't be stat'ed
+			parent.Files = append(parent.Files, &FSNode{Name: d.Name(), Err: errText(infoErr)})
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if opts.skip(nodeRel, d.IsDir() || followsToDir(fsys, name, d.Type(), opts), nodeDepth) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			f := getFolder(root, segments)
+			if err != nil {
+				// the second call for a directory which can't be read
+				f.Err = errText(err)
+				return nil
+			}
+			if opts.follow {
+				dirs[name] = info
+			}
+			if !opts.descend(nodeDepth) {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		node, target := fileNode(fsys, name, info, opts)
+		if target == nil {
+			if opts.archives && isArchive(name) && opts.descend(nodeDepth) {
+				node = walkArchive(fsys, name, node, nodeRel, nodeDepth, opts)
+			}
+			if node.IsDir {
+				parent.Folders[node.Name] = node
+			} else {
+				parent.Files = append(parent.Files, node)
+			}
+			return nil
+		}
+
+		parent.Folders[node.Name] = node
+		ancestors := chain[:len(chain):len(chain)]
+		for p := path.Dir(name); ; p = path.Dir(p) {
+			ancestors = append(ancestors, dirs[p])
+			if p == dir {
+				break
+			}
+		}
+		if isLoop(target, ancestors) {
+			node.Err = errLoop
+			return nil
+		}
+		if !opts.descend(nodeDepth) {
+			return nil
 		}
+		return walkFS(node, fsys, name, nodeRel, nodeDepth, ancestors, opts)
+	})
+}
+
+// printTree passes the children of f to the renderer, last describes the
+// position of f in the tree.
+func printTree(out io.Writer, f *FSNode, r renderer, last []bool, opts *options) {
+	fl := f.children(opts)
+
+	for i, node := range fl {
+		nodeLast := append(last[:len(last):len(last)], i == len(fl)-1)
+		r.node(out, node, node.label(opts), nodeLast)
 
 		if node.IsDir {
-			printTree(out, f.Folders[node.Name], subPrefix, printFiles)
+			r.enter(out, node, nodeLast)
+			printTree(out, node, r, nodeLast, opts)
+			r.leave(out, node, nodeLast)
 		}
 	}
 }
 
 type FSNode struct {
-	Name    string
-	Size    int64
-	IsDir   bool
-	Files   []*FSNode
-	Folders map[string]*FSNode
+	Name      string
+	Size      int64
+	IsDir     bool
+	Files     []*FSNode
+	Folders   map[string]*FSNode
+	FileCount int
+	DirCount  int
+	Hash      string
+	Status    string
+	OldSize   int64
+	Kind      string
+	Link      string
+	Err       string
+	Dupe      int
+	// counts of the old tree, set by aggregate for a diff
+	oldFileCount int
+	oldDirCount  int
+
+	// where the file can be read from, not set for loaded snapshots
+	fsys   fs.FS
+	fsPath string
+	// hash of the first partialSize bytes of an archive entry, which can't
+	// be read once the archive is closed
+	partialHash string
 }
 
 func (f *FSNode) String() string {
-	if f.IsDir {
-		return f.Name
+	return f.label(&options{})
+}
+
+// children returns the nodes of a folder in the order they are printed.
+func (f *FSNode) children(opts *options) []*FSNode {
+	fl := make([]*FSNode, 0, len(f.Folders)+len(f.Files))
+	for _, v := range f.Folders {
+		fl = append(fl, v)
 	}
 
-	var size string
-	if f.Size > 0 {
-		size = fmt.Sprintf("%vb", f.Size)
-	} else {
-		size = "empty"
+	if opts.printFiles {
+		for _, v := range f.Files {
+			fl = append(fl, v)
+		}
 	}
 
-	return fmt.Sprintf("%v (%v)", f.Name, size)
+	sortNodes(fl, opts.sortBy)
+
+	return fl
 }
 
 func newFolder(name string) *FSNode {
@@ -110,7 +331,7 @@ func newFolder(name string) *FSNode {
 }
 
 func getFolder(f *FSNode, path []string) *FSNode {
-	var folderSearch *FSNode
+	folderSearch := f
 	folderRoot := f
 	var ok bool
 	for _, segment := range path {
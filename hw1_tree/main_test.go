@@ -1,8 +1,17 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const testFullResult = `├───project
@@ -73,3 +82,696 @@ func TestTreeDir(t *testing.T) {
 		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testDirResult)
 	}
 }
+
+const testFilterResult = `├───project
+│	└───file.txt (19b)
+├───static
+│	├───empty.txt (empty)
+│	└───html
+│		└───index.html (57b)
+└───zzfile.txt (empty)
+`
+
+func TestTreeFilter(t *testing.T) {
+	out := new(bytes.Buffer)
+	opts, paths, err := parseArgs([]string{
+		"testdata", "-f", "-L", "3",
+		"--exclude", "zline/", "--exclude", "*_lorem", "--exclude", "/static/*s",
+		"--exclude", "*.png", "--exclude", "!*.png", "--exclude", "gopher.png",
+		"--include", "*.*",
+	})
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("parse args failed: %v %v", paths, err)
+	}
+	err = dirTreeOptions(out, paths[0], opts)
+	if err != nil {
+		t.Errorf("test for OK Failed - error")
+	}
+	result := out.String()
+	if result != testFilterResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testFilterResult)
+	}
+}
+
+func TestPatternList(t *testing.T) {
+	var l patternList
+	for _, v := range []string{"*.txt", "!empty.txt", "/static/css/"} {
+		if err := l.Set(v); err != nil {
+			t.Fatalf("unexpected error for %q: %v", v, err)
+		}
+	}
+	cases := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"zzfile.txt", false, true},
+		{"zline/lorem/dolor.txt", false, true},
+		{"zline/empty.txt", false, false},
+		{"static/css", true, true},
+		{"static/css", false, false},
+		{"project/static/css", true, false},
+	}
+	for _, c := range cases {
+		if got := l.match(c.rel, c.isDir); got != c.want {
+			t.Errorf("match(%q, %v) = %v, want %v", c.rel, c.isDir, got, c.want)
+		}
+	}
+	if err := l.Set("[a-"); err == nil {
+		t.Errorf("expected error for bad pattern")
+	}
+}
+
+func TestTreeSnapshot(t *testing.T) {
+	for _, format := range []string{formatJSON, formatXML} {
+		snapshot := new(bytes.Buffer)
+		err := dirTreeOptions(snapshot, "testdata", &options{printFiles: true, format: format})
+		if err != nil {
+			t.Fatalf("%s: write snapshot failed: %v", format, err)
+		}
+
+		root, err := loadTree(snapshot)
+		if err != nil {
+			t.Fatalf("%s: load snapshot failed: %v", format, err)
+		}
+		if root.Name != "testdata" {
+			t.Errorf("%s: wrong root name %q", format, root.Name)
+		}
+
+		out := new(bytes.Buffer)
+		err = writeTree(out, root, &options{printFiles: true})
+		if err != nil {
+			t.Errorf("%s: print snapshot failed: %v", format, err)
+		}
+		result := out.String()
+		if result != testFullResult {
+			t.Errorf("%s: results not match\nGot:\n%v\nExpected:\n%v", format, result, testFullResult)
+		}
+	}
+}
+
+func TestTreeSnapshotFiles(t *testing.T) {
+	// files are in a snapshot without -f
+	snapshot := new(bytes.Buffer)
+	if err := dirTreeOptions(snapshot, "testdata", &options{format: formatJSON}); err != nil {
+		t.Fatalf("write snapshot failed: %v", err)
+	}
+	root, err := loadTree(snapshot)
+	if err != nil {
+		t.Fatalf("load snapshot failed: %v", err)
+	}
+	out := new(bytes.Buffer)
+	if err = writeTree(out, root, &options{printFiles: true}); err != nil {
+		t.Errorf("print snapshot failed: %v", err)
+	}
+	if out.String() != testFullResult {
+		t.Errorf("results not match\nGot:\n%v\nExpected:\n%v", out, testFullResult)
+	}
+
+	if _, _, err = parseArgs([]string{"testdata", "--mark-dupes"}); err == nil {
+		t.Errorf("expected error for --mark-dupes without -f")
+	}
+}
+
+func TestLoadTreeBadInput(t *testing.T) {
+	for _, input := range []string{"", "  tree", `{"name": "file", "isDir": false}`, `<node name="x"`} {
+		if _, err := loadTree(strings.NewReader(input)); err == nil {
+			t.Errorf("expected error for %q", input)
+		}
+	}
+}
+
+const testDuResult = `├───lorem (140744b, files: 3, dirs: 1)
+│	├───gopher.png (70372b)
+│	├───ipsum (70372b, files: 1, dirs: 0)
+│	│	└───gopher.png (70372b)
+│	└───dolor.txt (empty)
+└───empty.txt (empty)
+`
+
+func TestTreeDu(t *testing.T) {
+	out := new(bytes.Buffer)
+	opts, paths, err := parseArgs([]string{"testdata/zline", "-f", "--du", "--sort=size"})
+	if err != nil {
+		t.Fatalf("parse args failed: %v", err)
+	}
+	err = dirTreeOptions(out, paths[0], opts)
+	if err != nil {
+		t.Errorf("test for OK Failed - error")
+	}
+	result := out.String()
+	if result != testDuResult {
+		t.Errorf("test for OK Failed - results not match\nGot:\n%v\nExpected:\n%v", result, testDuResult)
+	}
+
+	if _, _, err = parseArgs([]string{"testdata", "--sort=date"}); err == nil {
+		t.Errorf("expected error for unknown sort order")
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	cases := []struct {
+		size  int64
+		units string
+		want  string
+	}{
+		{0, unitsHuman, "empty"},
+		{1023, unitsHuman, "1023b"},
+		{70372, unitsBytes, "70372b"},
+		{70372, unitsHuman, "68.7KiB"},
+		{5 << 20, unitsHuman, "5.0MiB"},
+		{3 << 30, unitsHuman, "3.0GiB"},
+		{2 << 40, unitsHuman, "2.0TiB"},
+	}
+	for _, c := range cases {
+		if got := formatSize(c.size, c.units); got != c.want {
+			t.Errorf("formatSize(%d, %q) = %q, want %q", c.size, c.units, got, c.want)
+		}
+	}
+}
+
+// generateTree creates depth levels of fanout directories, each holding files small files.
+func generateTree(tb testing.TB, dir string, depth, fanout, files int) {
+	for i := 0; i < files; i++ {
+		name := filepath.Join(dir, fmt.Sprintf("file%d.txt", i))
+		if err := os.WriteFile(name, bytes.Repeat([]byte("x"), i), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if depth == 0 {
+		return
+	}
+	for i := 0; i < fanout; i++ {
+		sub := filepath.Join(dir, fmt.Sprintf("dir%d", i))
+		if err := os.Mkdir(sub, 0755); err != nil {
+			tb.Fatal(err)
+		}
+		generateTree(tb, sub, depth-1, fanout, files)
+	}
+}
+
+func TestScanTree(t *testing.T) {
+	generated := t.TempDir()
+	generateTree(t, generated, 3, 3, 4)
+
+	argsList := [][]string{
+		{"testdata", "-f"},
+		{"testdata"},
+		{"testdata", "-f", "-L", "2", "--exclude", "*.png", "--include", "*.txt"},
+		{generated, "-f", "--du"},
+	}
+	for _, args := range argsList {
+		opts, paths, err := parseArgs(args)
+		if err != nil {
+			t.Fatalf("parse args failed: %v", err)
+		}
+		expected := new(bytes.Buffer)
+		if err = dirTreeOptions(expected, paths[0], opts); err != nil {
+			t.Fatalf("walk failed: %v", err)
+		}
+
+		for _, workers := range []int{1, 4, 16} {
+			opts.workers = workers
+			out := new(bytes.Buffer)
+			if err = dirTreeOptions(out, paths[0], opts); err != nil {
+				t.Errorf("%v, %d workers: scan failed: %v", args, workers, err)
+			}
+			if out.String() != expected.String() {
+				t.Errorf("%v, %d workers: results not match\nGot:\n%v\nExpected:\n%v", args, workers, out, expected)
+			}
+		}
+		opts.workers = 0
+	}
+
+	if _, err := scanTree(filepath.Join(generated, "missing"), &options{}, 4); err == nil {
+		t.Errorf("expected error for missing directory")
+	}
+}
+
+func benchmarkTree(b *testing.B, workers int) {
+	dir := b.TempDir()
+	generateTree(b, dir, 4, 4, 8)
+	opts := &options{printFiles: true}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if workers == 0 {
+			_, err = walkTree(dir, opts)
+		} else {
+			_, err = scanTree(dir, opts, workers)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// -----
+// go test -bench . -benchmem
+
+func BenchmarkWalkTree(b *testing.B) {
+	benchmarkTree(b, 0)
+}
+
+func BenchmarkScanTree1(b *testing.B) {
+	benchmarkTree(b, 1)
+}
+
+func BenchmarkScanTree8(b *testing.B) {
+	benchmarkTree(b, 8)
+}
+
+func writeFiles(tb testing.TB, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+const testDiffResult = `├───[-] css
+│	└───[-] body.css (3b)
+├───[+] img
+│	└───[+] logo.png (4b)
+├───[+] index.html (empty)
+├───js
+│	├───[*] app.js (4b)
+│	└───[~] site.js (2b -> 5b)
+└───[-] old.txt (3b)
+`
+
+func TestTreeDiff(t *testing.T) {
+	oldDir, newDir := t.TempDir(), t.TempDir()
+	writeFiles(t, oldDir, map[string]string{
+		"css/body.css": "abc",
+		"js/site.js":   "ab",
+		"js/app.js":    "app1",
+		"old.txt":      "old",
+	})
+	writeFiles(t, newDir, map[string]string{
+		"js/site.js":   "abcde",
+		"js/app.js":    "app2",
+		"img/logo.png": "logo",
+		"index.html":   "",
+	})
+
+	snapshot := filepath.Join(t.TempDir(), "old.json")
+	file, err := os.Create(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dirTreeOptions(file, oldDir, &options{printFiles: true, hash: true, format: formatJSON})
+	file.Close()
+	if err != nil {
+		t.Fatalf("write snapshot failed: %v", err)
+	}
+
+	for _, old := range []string{oldDir, snapshot} {
+		out := new(bytes.Buffer)
+		opts, paths, err := parseArgs([]string{"diff", old, newDir, "-f", "--hash"})
+		if err != nil {
+			t.Fatalf("parse args failed: %v", err)
+		}
+		if err = diffTree(out, paths[1], paths[2], opts); err != nil {
+			t.Errorf("diff failed: %v", err)
+		}
+		result := out.String()
+		if result != testDiffResult {
+			t.Errorf("%s: results not match\nGot:\n%v\nExpected:\n%v", old, result, testDiffResult)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	if err = diffTree(out, oldDir, newDir, &options{printFiles: true}); err != nil {
+		t.Errorf("diff failed: %v", err)
+	}
+	if strings.Contains(out.String(), "[*]") {
+		t.Errorf("contents must not be compared without hash:\n%v", out)
+	}
+
+	// the sides are summed apart
+	expected := `├───[-] css (3b -> empty, files: 1 -> 0, dirs: 0 -> 0)
+│	└───[-] body.css (3b)
+├───[+] img (empty -> 4b, files: 0 -> 1, dirs: 0 -> 0)
+│	└───[+] logo.png (4b)
+├───[+] index.html (empty)
+├───js (6b -> 9b, files: 2 -> 2, dirs: 0 -> 0)
+│	├───app.js (4b)
+│	└───[~] site.js (2b -> 5b)
+└───[-] old.txt (3b)
+`
+	out.Reset()
+	if err = diffTree(out, oldDir, newDir, &options{printFiles: true, du: true, units: unitsBytes}); err != nil {
+		t.Errorf("diff failed: %v", err)
+	}
+	if out.String() != expected {
+		t.Errorf("results not match\nGot:\n%v\nExpected:\n%v", out, expected)
+	}
+}
+
+func TestTreeRenderers(t *testing.T) {
+	cases := map[string]string{
+		formatASCII: "|---empty.txt (empty)\n" +
+			"`---lorem\n" +
+			"\t|---dolor.txt (empty)\n" +
+			"\t|---gopher.png (70372b)\n" +
+			"\t`---ipsum\n" +
+			"\t\t`---gopher.png (70372b)\n",
+		formatMarkdown: "- empty.txt (empty)\n" +
+			"- lorem\n" +
+			"  - dolor.txt (empty)\n" +
+			"  - gopher.png (70372b)\n" +
+			"  - ipsum\n" +
+			"    - gopher.png (70372b)\n",
+	}
+	for format, expected := range cases {
+		out := new(bytes.Buffer)
+		if err := dirTreeOptions(out, "testdata/zline", &options{printFiles: true, format: format}); err != nil {
+			t.Errorf("%s: unexpected error: %v", format, err)
+		}
+		if out.String() != expected {
+			t.Errorf("%s: results not match\nGot:\n%v\nExpected:\n%v", format, out, expected)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	if err := dirTreeOptions(out, "testdata/zline", &options{printFiles: true, format: formatHTML}); err != nil {
+		t.Errorf("html: unexpected error: %v", err)
+	}
+	result := out.String()
+	for _, part := range []string{
+		"<title>testdata/zline</title>",
+		"  <li>empty.txt (empty)</li>\n  <li><details open><summary>lorem</summary>\n  <ul>\n",
+		"      <li>gopher.png (70372b)</li>\n    </ul>\n    </details></li>\n  </ul>\n  </details></li>\n</ul>\n</body>\n</html>\n",
+	} {
+		if !strings.Contains(result, part) {
+			t.Errorf("html: %q not found in\n%v", part, result)
+		}
+	}
+	if strings.Count(result, "<ul>") != strings.Count(result, "</ul>") {
+		t.Errorf("html: unbalanced lists\n%v", result)
+	}
+}
+
+// archiveTestdata packs testdata into a zip, a tar and a tar.gz file in dir.
+func archiveTestdata(t *testing.T, dir string) []string {
+	zipFile := new(bytes.Buffer)
+	zw := zip.NewWriter(zipFile)
+	tarFile := new(bytes.Buffer)
+	tw := tar.NewWriter(tarFile)
+
+	err := filepath.Walk("testdata", func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == "testdata" {
+			return err
+		}
+		rel, _ := filepath.Rel("testdata", path)
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			// zip directories are implied, tar keeps them explicitly
+			return tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: rel + "/", Mode: 0755})
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		w, err := zw.Create(rel)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+		if err = tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: rel, Mode: 0644, Size: int64(len(data))}); err != nil {
+			return err
+		}
+		_, err = tw.Write(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gzFile := new(bytes.Buffer)
+	gw := gzip.NewWriter(gzFile)
+	gw.Write(tarFile.Bytes())
+	gw.Close()
+
+	names := []string{
+		filepath.Join(dir, "testdata.zip"),
+		filepath.Join(dir, "testdata.tar"),
+		filepath.Join(dir, "testdata.tar.gz"),
+	}
+	for i, data := range []*bytes.Buffer{zipFile, tarFile, gzFile} {
+		if err = os.WriteFile(names[i], data.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return names
+}
+
+func TestTreeArchive(t *testing.T) {
+	dir := t.TempDir()
+	archives := archiveTestdata(t, dir)
+
+	for _, name := range archives {
+		for _, workers := range []int{0, 4} {
+			out := new(bytes.Buffer)
+			if err := dirTreeOptions(out, name, &options{printFiles: true, workers: workers}); err != nil {
+				t.Errorf("%s, %d workers: unexpected error: %v", name, workers, err)
+			}
+			result := out.String()
+			if result != testFullResult {
+				t.Errorf("%s, %d workers: results not match\nGot:\n%v\nExpected:\n%v", name, workers, result, testFullResult)
+			}
+		}
+	}
+
+	writeFiles(t, dir, map[string]string{"broken.zip": "not a zip"})
+	for _, workers := range []int{0, 4} {
+		out := new(bytes.Buffer)
+		opts := &options{printFiles: true, archives: true, maxDepth: 2, workers: workers}
+		if err := dirTreeOptions(out, dir, opts); err != nil {
+			t.Errorf("%d workers: unexpected error: %v", workers, err)
+		}
+		result := out.String()
+		for _, part := range []string{
+			"├───broken.zip (9b) [zip: not a valid zip file]\n",
+			"├───testdata.tar\n│	├───project\n│	├───static\n",
+			"└───testdata.zip\n	├───project\n	├───static\n	├───zline\n	└───zzfile.txt (empty)\n",
+		} {
+			if !strings.Contains(result, part) {
+				t.Errorf("%d workers: %q not found in\n%v", workers, part, result)
+			}
+		}
+	}
+
+	// the contents of the entries are read like those of zip ones
+	var dupes []string
+	for _, name := range archives {
+		out := new(bytes.Buffer)
+		opts := &options{printFiles: true, hash: true, dupes: true, units: unitsBytes, workers: 4}
+		if err := dirTreeOptions(out, name, opts); err != nil {
+			t.Errorf("%s: unexpected error: %v", name, err)
+		}
+		dupes = append(dupes, strings.ReplaceAll(out.String(), name, "archive"))
+	}
+	if !strings.Contains(dupes[0], "#1: 7 files of 70372b") || dupes[1] != dupes[0] || dupes[2] != dupes[0] {
+		t.Errorf("results not match\nGot:\n%v\nExpected for all:\n%v", strings.Join(dupes[1:], "\n"), dupes[0])
+	}
+
+	// a zip inside a tar inside a tar.gz
+	zipData, _ := os.ReadFile(archives[0])
+	inner, gzFile := new(bytes.Buffer), new(bytes.Buffer)
+	tw := tar.NewWriter(inner)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "data/testdata.zip", Mode: 0644, Size: int64(len(zipData))})
+	tw.Write(zipData)
+	tw.Close()
+	gw := gzip.NewWriter(gzFile)
+	tw = tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "inner.tar", Mode: 0644, Size: int64(inner.Len())})
+	tw.Write(inner.Bytes())
+	tw.Close()
+	gw.Close()
+	nested := filepath.Join(t.TempDir(), "nested.tgz")
+	writeFiles(t, filepath.Dir(nested), map[string]string{"nested.tgz": gzFile.String()})
+
+	out := new(bytes.Buffer)
+	opts := &options{printFiles: true, archives: true, hash: true}
+	if err := dirTreeOptions(out, nested, opts); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := "└───inner.tar\n\t└───data\n\t\t└───testdata.zip\n\t\t\t├───project\n\t\t\t│\t├───file.txt (19b)\n"
+	if !strings.HasPrefix(out.String(), expected) || strings.Contains(out.String(), "[") {
+		t.Errorf("results not match\nGot:\n%v\nExpected prefix:\n%v", out, expected)
+	}
+}
+
+const testDupesResult = `#1: 2 files of 4.9KiB, 4.9KiB reclaimable
+	%[1]s/a.bin
+	%[1]s/sub/b.bin
+#2: 3 files of 2b, 4b reclaimable
+	%[1]s/hi.txt
+	%[1]s/sub/hi.txt
+	%[1]s/sub/hi2.txt
+duplicate groups: 2, reclaimable: 4.9KiB
+`
+
+func TestTreeDupes(t *testing.T) {
+	dir := t.TempDir()
+	big := strings.Repeat("x", 5000)
+	writeFiles(t, dir, map[string]string{
+		"a.bin":       big,
+		"sub/b.bin":   big,
+		"c.bin":       big[:4999] + "y",
+		"d.bin":       "y" + big[1:],
+		"hi.txt":      "hi",
+		"sub/hi.txt":  "hi",
+		"sub/hi2.txt": "hi",
+		"ho.txt":      "ho",
+		"empty.txt":   "",
+		"sub/e.txt":   "",
+	})
+
+	for _, workers := range []int{0, 1, 4} {
+		out := new(bytes.Buffer)
+		opts := &options{dupes: true, units: unitsHuman, workers: workers}
+		if err := dirTreeOptions(out, dir, opts); err != nil {
+			t.Errorf("%d workers: unexpected error: %v", workers, err)
+		}
+		expected := fmt.Sprintf(testDupesResult, dir)
+		if out.String() != expected {
+			t.Errorf("%d workers: results not match\nGot:\n%v\nExpected:\n%v", workers, out, expected)
+		}
+	}
+
+	out := new(bytes.Buffer)
+	if err := dirTreeOptions(out, dir, &options{printFiles: true, markDupes: true}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := `├───a.bin (5000b) [dup #1]
+├───c.bin (5000b)
+├───d.bin (5000b)
+├───empty.txt (empty)
+├───hi.txt (2b) [dup #2]
+├───ho.txt (2b)
+└───sub
+	├───b.bin (5000b) [dup #1]
+	├───e.txt (empty)
+	├───hi.txt (2b) [dup #2]
+	└───hi2.txt (2b) [dup #2]
+`
+	if out.String() != expected {
+		t.Errorf("results not match\nGot:\n%v\nExpected:\n%v", out, expected)
+	}
+}
+
+func TestTreeDupesArchive(t *testing.T) {
+	dir := t.TempDir()
+	big := strings.Repeat("x", 5000)
+	zipFile := new(bytes.Buffer)
+	zw := zip.NewWriter(zipFile)
+	w, _ := zw.Create("a.bin")
+	w.Write([]byte(big))
+	zw.Close()
+	writeFiles(t, dir, map[string]string{"a.bin": big, "pack.zip": zipFile.String()})
+
+	out := new(bytes.Buffer)
+	opts := &options{dupes: true, archives: true, units: unitsBytes}
+	if err := dirTreeOptions(out, dir, opts); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	expected := fmt.Sprintf("#1: 2 files of 5000b, 5000b reclaimable\n\t%[1]s/a.bin\n\t%[1]s/pack.zip/a.bin\n", dir)
+	if !strings.HasPrefix(out.String(), expected) {
+		t.Errorf("results not match\nGot:\n%v\nExpected prefix:\n%v", out, expected)
+	}
+}
+
+// syncBuffer lets the test read what the watch loop writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitOutput(t *testing.T, out *syncBuffer, expected string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(out.String(), expected) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%q not found in\n%v", expected, out)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTreeWatch(t *testing.T) {
+	testCases := []struct {
+		poll     time.Duration
+		debounce time.Duration
+	}{
+		{0, 20 * time.Millisecond},
+		{20 * time.Millisecond, 20 * time.Millisecond},
+		// the poller ticks faster than the debounce
+		{20 * time.Millisecond, 100 * time.Millisecond},
+	}
+	for _, c := range testCases {
+		poll := c.poll
+		dir := t.TempDir()
+		writeFiles(t, dir, map[string]string{"old.txt": "old", "skip/file.txt": "x"})
+
+		out := &syncBuffer{}
+		stop := make(chan struct{})
+		result := make(chan error)
+		opts := &options{printFiles: true, summary: true, debounce: c.debounce, poll: poll}
+		opts.exclude.Set("skip/")
+		go func() {
+			result <- watchTree(out, dir, opts, stop)
+		}()
+
+		waitOutput(t, out, "└───old.txt (3b)\n")
+		writeFiles(t, dir, map[string]string{"a.txt": "a"})
+		waitOutput(t, out, "+ a.txt\n")
+		writeFiles(t, dir, map[string]string{"a.txt": "abc", "skip/new.txt": "x"})
+		waitOutput(t, out, "~ a.txt (1b -> 3b)\n")
+		writeFiles(t, dir, map[string]string{"sub/deep/b.txt": "b"})
+		waitOutput(t, out, "+ sub/\n")
+		writeFiles(t, dir, map[string]string{"sub/deep/c.txt": "c"})
+		waitOutput(t, out, "+ sub/deep/c.txt\n")
+		if err := os.RemoveAll(filepath.Join(dir, "sub")); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Remove(filepath.Join(dir, "old.txt")); err != nil {
+			t.Fatal(err)
+		}
+		waitOutput(t, out, "- sub/\n")
+		waitOutput(t, out, "- old.txt\n")
+
+		close(stop)
+		if err := <-result; err != nil {
+			t.Errorf("poll %v: unexpected error: %v", poll, err)
+		}
+		if strings.Contains(out.String(), "skip") {
+			t.Errorf("poll %v: excluded directory is watched\n%v", poll, out)
+		}
+	}
+}
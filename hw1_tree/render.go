@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+)
+
+const (
+	formatASCII    = "ascii"
+	formatMarkdown = "markdown"
+	formatHTML     = "html"
+)
+
+// renderer draws the tree walked by printTree. last holds a flag for every
+// level from the top down to the node itself: whether it is the last child
+// of its parent. enter and leave wrap the children of a directory.
+type renderer interface {
+	begin(out io.Writer, root *FSNode)
+	node(out io.Writer, f *FSNode, label string, last []bool)
+	enter(out io.Writer, f *FSNode, last []bool)
+	leave(out io.Writer, f *FSNode, last []bool)
+	end(out io.Writer, root *FSNode)
+}
+
+var renderers = map[string]renderer{
+	formatText:     &glyphRenderer{branch: "├───", lastBranch: "└───", pipe: "│\t", space: "\t"},
+	formatASCII:    &glyphRenderer{branch: "|---", lastBranch: "`---", pipe: "|\t", space: "\t"},
+	formatMarkdown: markdownRenderer{},
+	formatHTML:     htmlRenderer{},
+}
+
+// glyphRenderer draws the classic tree with box-drawing or plain characters.
+type glyphRenderer struct {
+	branch     string
+	lastBranch string
+	pipe       string
+	space      string
+}
+
+func (r *glyphRenderer) begin(out io.Writer, root *FSNode)           {}
+func (r *glyphRenderer) enter(out io.Writer, f *FSNode, last []bool) {}
+func (r *glyphRenderer) leave(out io.Writer, f *FSNode, last []bool) {}
+func (r *glyphRenderer) end(out io.Writer, root *FSNode)             {}
+
+func (r *glyphRenderer) node(out io.Writer, f *FSNode, label string, last []bool) {
+	prefix := new(strings.Builder)
+	for _, l := range last[:len(last)-1] {
+		if l {
+			prefix.WriteString(r.space)
+		} else {
+			prefix.WriteString(r.pipe)
+		}
+	}
+	if last[len(last)-1] {
+		prefix.WriteString(r.lastBranch)
+	} else {
+		prefix.WriteString(r.branch)
+	}
+	fmt.Fprintf(out, "%v%v\n", prefix, label)
+}
+
+// markdownRenderer draws nested lists.
+type markdownRenderer struct{}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "`", "\\`", `*`, `\*`, `_`, `\_`, `[`, `\[`, `]`, `\]`, `<`, `\<`, `>`, `\>`,
+)
+
+func (markdownRenderer) begin(out io.Writer, root *FSNode)           {}
+func (markdownRenderer) enter(out io.Writer, f *FSNode, last []bool) {}
+func (markdownRenderer) leave(out io.Writer, f *FSNode, last []bool) {}
+func (markdownRenderer) end(out io.Writer, root *FSNode)             {}
+
+func (markdownRenderer) node(out io.Writer, f *FSNode, label string, last []bool) {
+	fmt.Fprintf(out, "%v- %v\n", strings.Repeat("  ", len(last)-1), markdownEscaper.Replace(label))
+}
+
+// htmlRenderer draws a standalone page, directories are collapsible.
+type htmlRenderer struct{}
+
+func (htmlRenderer) begin(out io.Writer, root *FSNode) {
+	fmt.Fprintf(out, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%v</title>
+<style>
+ul { list-style: none; padding-left: 1.5em; }
+summary { cursor: pointer; }
+</style>
+</head>
+<body>
+<h1>%[1]v</h1>
+<ul>
+`, html.EscapeString(root.Name))
+}
+
+func (htmlRenderer) node(out io.Writer, f *FSNode, label string, last []bool) {
+	indent := strings.Repeat("  ", len(last))
+	if f.IsDir {
+		fmt.Fprintf(out, "%v<li><details open><summary>%v</summary>\n", indent, html.EscapeString(label))
+	} else {
+		fmt.Fprintf(out, "%v<li>%v</li>\n", indent, html.EscapeString(label))
+	}
+}
+
+func (htmlRenderer) enter(out io.Writer, f *FSNode, last []bool) {
+	fmt.Fprintf(out, "%v<ul>\n", strings.Repeat("  ", len(last)))
+}
+
+func (htmlRenderer) leave(out io.Writer, f *FSNode, last []bool) {
+	indent := strings.Repeat("  ", len(last))
+	fmt.Fprintf(out, "%v</ul>\n%[1]v</details></li>\n", indent)
+}
+
+func (htmlRenderer) end(out io.Writer, root *FSNode) {
+	fmt.Fprint(out, "</ul>\n</body>\n</html>\n")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"io/fs"
+	"path"
+	"sync"
+)
+
+type scanJob struct {
+	node  *FSNode
+	fsys  fs.FS
+	path  string
+	rel   string
+	depth int
+	// directories from the root down to this one, only kept with --follow
+	chain []fs.FileInfo
+}
+
+// scanner reads directories with a fixed pool of workers. Every job owns
+// its node exclusively, so only the queue needs the lock.
+type scanner struct {
+	opts *options
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []scanJob
+	pending int
+	err     error
+	closers []func() error
+}
+
+// scanTree builds the same tree as walkTree, but reads up to workers
+// directories concurrently.
+func scanTree(startPath string, opts *options, workers int) (*FSNode, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	fsys, done, err := openSource(startPath)
+	if err != nil {
+		return nil, err
+	}
+
+	root := newFolder(startPath)
+	job := scanJob{node: root, fsys: fsys, path: "."}
+	if opts.follow {
+		info, err := fs.Stat(fsys, ".")
+		if err != nil {
+			done()
+			return nil, err
+		}
+		job.chain = []fs.FileInfo{info}
+	}
+	s := &scanner{
+		opts:    opts,
+		queue:   []scanJob{job},
+		pending: 1,
+		closers: []func() error{done},
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.work()
+		}()
+	}
+	wg.Wait()
+
+	for _, done := range s.closers {
+		done()
+	}
+	return root, s.err
+}
+
+func (s *scanner) work() {
+	for {
+		s.mu.Lock()
+		for len(s.queue) == 0 && s.pending > 0 {
+			s.cond.Wait()
+		}
+		if s.pending == 0 {
+			s.mu.Unlock()
+			return
+		}
+		// LIFO keeps the queue as small as a depth-first walk would
+		job := s.queue[len(s.queue)-1]
+		s.queue = s.queue[:len(s.queue)-1]
+		failed := s.err != nil
+		s.mu.Unlock()
+
+		var jobs []scanJob
+		var err error
+		if !failed {
+			jobs, err = s.readDir(job)
+		}
+
+		s.mu.Lock()
+		if err != nil && s.err == nil {
+			s.err = err
+		}
+		if s.err == nil {
+			s.queue = append(s.queue, jobs...)
+			s.pending += len(jobs)
+		}
+		s.pending--
+		s.mu.Unlock()
+		s.cond.Broadcast()
+	}
+}
+
+func (s *scanner) readDir(job scanJob) ([]scanJob, error) {
+	entries, err := fs.ReadDir(job.fsys, job.path)
+	if err != nil {
+		if job.rel == "" {
+			return nil, err
+		}
+		job.node.Err = errText(err)
+		return nil, nil
+	}
+
+	var jobs []scanJob
+	depth := job.depth + 1
+	for _, entry := range entries {
+		name := path.Join(job.path, entry.Name())
+		rel := joinRel(job.rel, entry.Name())
+
+		info, err := entry.Info()
+		if err != nil {
+			// the entry was listed but can't be stat'ed
+			job.node.Files = append(job.node.Files, &FSNode{Name: entry.Name(), Err: errText(err)})
+			continue
+		}
+		if s.opts.skip(rel, entry.IsDir() || followsToDir(job.fsys, name, entry.Type(), s.opts), depth) {
+			continue
+		}
+
+		if entry.IsDir() {
+			f := newFolder(entry.Name())
+			job.node.Folders[f.Name] = f
+			if !s.opts.descend(depth) {
+				continue
+			}
+			sub := scanJob{node: f, fsys: job.fsys, path: name, rel: rel, depth: depth}
+			if s.opts.follow {
+				sub.chain = append(job.chain[:len(job.chain):len(job.chain)], info)
+			}
+			jobs = append(jobs, sub)
+			continue
+		}
+
+		node, target := fileNode(job.fsys, name, info, s.opts)
+		if target == nil {
+			if s.opts.archives && isArchive(name) && s.opts.descend(depth) {
+				if sub, ok := s.openArchive(job.fsys, name, node, rel, depth); ok {
+					node = sub.node
+					jobs = append(jobs, sub)
+				}
+			}
+			if node.IsDir {
+				job.node.Folders[node.Name] = node
+			} else {
+				job.node.Files = append(job.node.Files, node)
+			}
+			continue
+		}
+
+		job.node.Folders[node.Name] = node
+		if isLoop(target, job.chain) {
+			node.Err = errLoop
+			continue
+		}
+		if s.opts.descend(depth) {
+			chain := append(job.chain[:len(job.chain):len(job.chain)], target)
+			jobs = append(jobs, scanJob{node: node, fsys: job.fsys, path: name, rel: rel, depth: depth, chain: chain})
+		}
+	}
+	return jobs, nil
+}
+
+// openArchive makes a job for the contents of an archive, the archive stays
+// open until the scan is over.
+func (s *scanner) openArchive(fsys fs.FS, name string, file *FSNode, rel string, depth int) (scanJob, bool) {
+	archive, done, err := openArchive(fsys, name)
+	if err != nil {
+		file.Err = errText(err)
+		return scanJob{}, false
+	}
+	s.mu.Lock()
+	s.closers = append(s.closers, done)
+	s.mu.Unlock()
+
+	return scanJob{node: newFolder(file.Name), fsys: archive, path: ".", rel: rel, depth: depth}, true
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	sortName = "name"
+	sortSize = "size"
+
+	unitsBytes = "b"
+	unitsHuman = "human"
+)
+
+// aggregate sums sizes of all files below f into f.Size and counts files
+// and directories of the whole subtree, like du does.
+func (f *FSNode) aggregate() {
+	if !f.IsDir {
+		return
+	}
+	f.Size, f.FileCount, f.DirCount = 0, 0, 0
+	for _, d := range f.Folders {
+		d.aggregate()
+		f.Size += d.Size
+		f.FileCount += d.FileCount
+		f.DirCount += d.DirCount + 1
+	}
+	for _, file := range f.Files {
+		f.Size += file.Size
+		f.FileCount++
+	}
+}
+
+// aggregateDiff is aggregate of a diff tree, where the sides are summed
+// apart: Size and the counts are of the new tree, OldSize and the old
+// counts of the old one. A removed node is only in the old tree, an added
+// one only in the new.
+func (f *FSNode) aggregateDiff() {
+	if !f.IsDir {
+		return
+	}
+	f.Size, f.FileCount, f.DirCount = 0, 0, 0
+	f.OldSize, f.oldFileCount, f.oldDirCount = 0, 0, 0
+	for _, d := range f.Folders {
+		d.aggregateDiff()
+		f.Size += d.Size
+		f.FileCount += d.FileCount
+		f.DirCount += d.DirCount
+		if d.Status != statusRemoved {
+			f.DirCount++
+		}
+		f.OldSize += d.OldSize
+		f.oldFileCount += d.oldFileCount
+		f.oldDirCount += d.oldDirCount
+		if d.Status != statusAdded {
+			f.oldDirCount++
+		}
+	}
+	for _, file := range f.Files {
+		switch file.Status {
+		case statusAdded:
+			f.Size += file.Size
+			f.FileCount++
+		case statusRemoved:
+			f.OldSize += file.Size
+			f.oldFileCount++
+		case statusResized:
+			f.Size += file.Size
+			f.OldSize += file.OldSize
+			f.FileCount++
+			f.oldFileCount++
+		default:
+			f.Size += file.Size
+			f.OldSize += file.Size
+			f.FileCount++
+			f.oldFileCount++
+		}
+	}
+}
+
+func sortNodes(fl []*FSNode, sortBy string) {
+	if sortBy == sortSize {
+		sort.Slice(fl, func(i, j int) bool {
+			if fl[i].Size != fl[j].Size {
+				return fl[i].Size > fl[j].Size
+			}
+			return fl[i].Name < fl[j].Name
+		})
+		return
+	}
+	sort.Slice(fl, func(i, j int) bool {
+		return fl[i].Name < fl[j].Name
+	})
+}
+
+func formatSize(size int64, units string) string {
+	if size == 0 {
+		return "empty"
+	}
+	if units != unitsHuman || size < 1024 {
+		return fmt.Sprintf("%vb", size)
+	}
+	value := float64(size) / 1024
+	for _, unit := range []string{"KiB", "MiB", "GiB"} {
+		if value < 1024 {
+			return fmt.Sprintf("%.1f%s", value, unit)
+		}
+		value /= 1024
+	}
+	return fmt.Sprintf("%.1fTiB", value)
+}
+
+// label is the text of a node in the tree, without options it is the same
+// as String.
+func (f *FSNode) label(opts *options) string {
+	var s string
+	switch {
+	case f.Status == statusResized:
+		s = fmt.Sprintf("%v (%v -> %v)", f.Name, formatSize(f.OldSize, opts.units), formatSize(f.Size, opts.units))
+	case f.Link != "":
+		s = fmt.Sprintf("%v -> %v", f.Name, f.Link)
+	case f.Kind != "":
+		s = fmt.Sprintf("%v [%v]", f.Name, f.Kind)
+	case !f.IsDir && f.Err != "" && f.Size == 0:
+		// nothing is known about the file but the error
+		s = f.Name
+	case !f.IsDir:
+		s = fmt.Sprintf("%v (%v)", f.Name, formatSize(f.Size, opts.units))
+	case !opts.du:
+		s = f.Name
+	case opts.diff:
+		s = fmt.Sprintf("%v (%v -> %v, files: %d -> %d, dirs: %d -> %d)", f.Name,
+			formatSize(f.OldSize, opts.units), formatSize(f.Size, opts.units),
+			f.oldFileCount, f.FileCount, f.oldDirCount, f.DirCount)
+	default:
+		s = fmt.Sprintf("%v (%v, files: %d, dirs: %d)", f.Name, formatSize(f.Size, opts.units), f.FileCount, f.DirCount)
+	}
+	if f.Err != "" {
+		s += " [" + f.Err + "]"
+	}
+	if f.Dupe > 0 {
+		s += fmt.Sprintf(" [dup #%d]", f.Dupe)
+	}
+	if f.Status != "" {
+		s = "[" + f.Status + "] " + s
+	}
+	return s
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+const (
+	kindSymlink    = "symlink"
+	kindSocket     = "socket"
+	kindFifo       = "fifo"
+	kindDevice     = "device"
+	kindCharDevice = "char device"
+
+	errLoop = "loop"
+)
+
+// fileNode describes an entry which is not a directory. A followed symlink
+// to a directory is returned as a folder along with the target info, the
+// caller has to check it for loops and descend into it.
+func fileNode(fsys fs.FS, name string, info fs.FileInfo, opts *options) (*FSNode, fs.FileInfo) {
+	node := &FSNode{Name: info.Name(), Size: info.Size(), fsys: fsys, fsPath: name}
+	mode := info.Mode()
+
+	switch {
+	case mode&fs.ModeSymlink != 0:
+		node.Kind = kindSymlink
+		node.Size = 0
+		target, err := fs.ReadLink(fsys, name)
+		if err != nil {
+			node.Err = errText(err)
+			return node, nil
+		}
+		node.Link = target
+		if !opts.follow {
+			return node, nil
+		}
+		targetInfo, err := fs.Stat(fsys, name)
+		if err != nil {
+			node.Err = errText(err)
+			return node, nil
+		}
+		if targetInfo.IsDir() {
+			folder := newFolder(node.Name)
+			folder.Kind = node.Kind
+			folder.Link = node.Link
+			return folder, targetInfo
+		}
+		node.Size = targetInfo.Size()
+		mode = targetInfo.Mode()
+	case mode&fs.ModeSocket != 0:
+		node.Kind = kindSocket
+	case mode&fs.ModeNamedPipe != 0:
+		node.Kind = kindFifo
+	case mode&fs.ModeCharDevice != 0:
+		node.Kind = kindCharDevice
+	case mode&fs.ModeDevice != 0:
+		node.Kind = kindDevice
+	}
+
+	if node.Kind != "" && node.Kind != kindSymlink {
+		node.Size = 0
+	}
+	// an archive is closed once it is walked, so the duplicates in it are
+	// found by the hashes taken now, like the ones of a snapshot
+	kept := inArchive(fsys) && (opts.dupes || opts.markDupes)
+	if (opts.hash || kept) && mode.IsRegular() {
+		var err error
+		if node.Hash, err = hashFile(fsys, name, -1); err != nil {
+			node.Err = errText(err)
+		}
+	}
+	if kept && mode.IsRegular() && node.Err == "" {
+		node.partialHash = node.Hash
+		if node.Size > partialSize {
+			// findDupes compares it with the partial hashes of files on disk
+			node.partialHash, _ = hashFile(fsys, name, partialSize)
+		}
+	}
+	if kept {
+		node.fsys = nil
+	}
+	return node, nil
+}
+
+// followsToDir reports whether the entry is a symlink to a directory which
+// has to be followed.
+func followsToDir(fsys fs.FS, name string, mode fs.FileMode, opts *options) bool {
+	if !opts.follow || mode&fs.ModeSymlink == 0 {
+		return false
+	}
+	info, err := fs.Stat(fsys, name)
+	return err == nil && info.IsDir()
+}
+
+// isLoop reports whether target is one of the directories above the link.
+func isLoop(target fs.FileInfo, chain []fs.FileInfo) bool {
+	for _, dir := range chain {
+		if dir != nil && os.SameFile(target, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// errText drops the path from the error, the tree already shows it.
+func errText(err error) string {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err.Error()
+	}
+	return err.Error()
+}
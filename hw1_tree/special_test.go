@@ -0,0 +1,122 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// specialTree builds a fixture which can't be kept in testdata: links,
+// a loop, a fifo and a socket.
+func specialTree(t *testing.T) string {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"a.txt":     "abc",
+		"dir/b.txt": "b",
+	})
+	links := map[string]string{
+		"link_file": "a.txt",
+		"link_dir":  "dir",
+		"dir/up":    "..",
+		"broken":    "missing",
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := syscall.Mkfifo(filepath.Join(dir, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("unix", filepath.Join(dir, "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return dir
+}
+
+const testSpecialResult = `├───a.txt (3b)
+├───broken -> missing
+├───dir
+│	├───b.txt (1b)
+│	└───up -> ..
+├───fifo [fifo]
+├───link_dir -> dir
+├───link_file -> a.txt
+└───sock [socket]
+`
+
+const testFollowResult = `├───a.txt (3b)
+├───broken -> missing [no such file or directory]
+├───dir
+│	├───b.txt (1b)
+│	└───up -> .. [loop]
+├───fifo [fifo]
+├───link_dir -> dir
+│	├───b.txt (1b)
+│	└───up -> .. [loop]
+├───link_file -> a.txt
+└───sock [socket]
+`
+
+func TestTreeSpecial(t *testing.T) {
+	dir := specialTree(t)
+
+	cases := []struct {
+		opts     *options
+		expected string
+	}{
+		{&options{printFiles: true, hash: true}, testSpecialResult},
+		{&options{printFiles: true, hash: true, workers: 4}, testSpecialResult},
+		{&options{printFiles: true, hash: true, follow: true}, testFollowResult},
+		{&options{printFiles: true, hash: true, follow: true, workers: 4}, testFollowResult},
+	}
+	for _, c := range cases {
+		out := new(bytes.Buffer)
+		if err := dirTreeOptions(out, dir, c.opts); err != nil {
+			t.Errorf("%+v: unexpected error: %v", c.opts, err)
+		}
+		result := out.String()
+		if result != c.expected {
+			t.Errorf("%+v: results not match\nGot:\n%v\nExpected:\n%v", c.opts, result, c.expected)
+		}
+	}
+}
+
+const testDeniedResult = `├───locked [permission denied]
+└───open
+	└───file.txt (2b)
+`
+
+func TestTreePermissionDenied(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any directory")
+	}
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"locked/secret.txt": "secret",
+		"open/file.txt":     "ok",
+	})
+	locked := filepath.Join(dir, "locked")
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(locked, 0755) })
+
+	for _, workers := range []int{0, 4} {
+		out := new(bytes.Buffer)
+		if err := dirTreeOptions(out, dir, &options{printFiles: true, workers: workers}); err != nil {
+			t.Errorf("%d workers: unexpected error: %v", workers, err)
+		}
+		result := out.String()
+		if result != testDeniedResult {
+			t.Errorf("%d workers: results not match\nGot:\n%v\nExpected:\n%v", workers, result, testDeniedResult)
+		}
+	}
+}
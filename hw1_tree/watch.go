@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDebounce = 100 * time.Millisecond
+	defaultPoll     = time.Second
+)
+
+// notifier reports directories, relative to the root, whose entries might
+// have changed. The watch loop tells it about added and removed ones.
+type notifier interface {
+	changes() <-chan string
+	add(rel string) error
+	remove(rel string)
+	close() error
+}
+
+type change struct {
+	op      string
+	rel     string
+	oldSize int64
+	size    int64
+}
+
+func (c change) String() string {
+	if c.op == statusResized {
+		return fmt.Sprintf("%v %v (%v -> %v)", c.op, c.rel, formatSize(c.oldSize, unitsBytes), formatSize(c.size, unitsBytes))
+	}
+	return c.op + " " + c.rel
+}
+
+// treeWatcher keeps the tree of a directory up to date, every refresh
+// rereads only the directories reported by the notifier.
+type treeWatcher struct {
+	root   *FSNode
+	fsys   fs.FS
+	opts   *options
+	notify notifier
+}
+
+// watchTree prints the tree and then the changes, or the whole tree again,
+// each time the directory changes, until stop is closed.
+func watchTree(out io.Writer, startPath string, opts *options, stop <-chan struct{}) error {
+	info, err := os.Stat(startPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", startPath)
+	}
+
+	w := &treeWatcher{root: newFolder(startPath), fsys: os.DirFS(startPath), opts: opts}
+	if err = walkFS(w.root, w.fsys, ".", "", 0, nil, opts); err != nil {
+		return err
+	}
+	if err = writeTree(out, w.root, opts); err != nil {
+		return err
+	}
+
+	if opts.poll <= 0 {
+		w.notify, err = newInotify(startPath)
+	}
+	if opts.poll > 0 || err != nil {
+		interval := opts.poll
+		if interval <= 0 {
+			interval = defaultPoll
+		}
+		w.notify = newPoller(interval)
+	}
+	defer w.notify.close()
+	w.watchDirs(w.root, "", 0)
+
+	debounce := opts.debounce
+	if debounce <= 0 {
+		debounce = defaultDebounce
+	}
+	dirty := make(map[string]bool)
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			timer.Stop()
+			return nil
+		case rel := <-w.notify.changes():
+			// the deadline isn't moved by later changes: the poller reports
+			// every directory on each tick, it would put the refresh off for
+			// good if the ticks come faster than the debounce
+			if len(dirty) == 0 {
+				timer.Reset(debounce)
+			}
+			dirty[rel] = true
+		case <-timer.C:
+			changes := w.refresh(dirty)
+			dirty = make(map[string]bool)
+			if len(changes) == 0 {
+				continue
+			}
+			if opts.summary {
+				for _, c := range changes {
+					fmt.Fprintln(out, c)
+				}
+				continue
+			}
+			fmt.Fprintln(out)
+			if err = writeTree(out, w.root, opts); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// refresh rereads the dirty directories, parents go first so that a
+// directory removed together with its parent is not read at all.
+func (w *treeWatcher) refresh(dirty map[string]bool) []change {
+	rels := make([]string, 0, len(dirty))
+	for rel := range dirty {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+
+	var changes []change
+	for _, rel := range rels {
+		changes = append(changes, w.refreshDir(rel)...)
+	}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].rel < changes[j].rel
+	})
+	return changes
+}
+
+func (w *treeWatcher) refreshDir(rel string) []change {
+	node := w.root
+	depth := 0
+	name := "."
+	if rel != "" {
+		for _, segment := range strings.Split(rel, "/") {
+			if node = node.Folders[segment]; node == nil {
+				return nil
+			}
+		}
+		depth = strings.Count(rel, "/") + 1
+		name = rel
+	}
+	if !w.opts.descend(depth) {
+		return nil
+	}
+
+	entries, err := fs.ReadDir(w.fsys, name)
+	if err != nil {
+		// removed meanwhile, the parent will be refreshed too
+		return nil
+	}
+
+	var changes []change
+	current := make(map[string]fs.DirEntry, len(entries))
+	for _, entry := range entries {
+		entryRel := joinRel(rel, entry.Name())
+		isDir := entry.IsDir() || followsToDir(w.fsys, path.Join(name, entry.Name()), entry.Type(), w.opts)
+		if !w.opts.skip(entryRel, isDir, depth+1) {
+			current[entry.Name()] = entry
+		}
+	}
+
+	// removals first: a renamed directory must lose its old watch before
+	// the new name gets one
+	for childName, folder := range node.Folders {
+		entry, ok := current[childName]
+		// followed links and archives are folders in the tree but not on disk
+		replaced := ok && !entry.IsDir() && folder.Link == "" && !isArchive(childName)
+		if !ok || replaced {
+			delete(node.Folders, childName)
+			w.unwatchDirs(folder, joinRel(rel, childName))
+			changes = append(changes, change{op: statusRemoved, rel: joinRel(rel, childName) + "/"})
+		}
+	}
+	files := node.Files[:0]
+	for _, file := range node.Files {
+		if entry, ok := current[file.Name]; ok && !entry.IsDir() {
+			files = append(files, file)
+		} else {
+			changes = append(changes, change{op: statusRemoved, rel: joinRel(rel, file.Name)})
+		}
+	}
+	node.Files = files
+
+	existing := make(map[string]*FSNode, len(node.Files))
+	for _, file := range node.Files {
+		existing[file.Name] = file
+	}
+	for _, entry := range entries {
+		if _, ok := current[entry.Name()]; !ok {
+			continue
+		}
+		childName := path.Join(name, entry.Name())
+		childRel := joinRel(rel, entry.Name())
+		if _, ok := node.Folders[entry.Name()]; ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		if old, ok := existing[entry.Name()]; ok {
+			if old.Size != info.Size() && info.Mode().IsRegular() {
+				changes = append(changes, change{op: statusResized, rel: childRel, oldSize: old.Size, size: info.Size()})
+				updated, _ := fileNode(w.fsys, childName, info, w.opts)
+				*old = *updated
+			}
+			continue
+		}
+
+		child := w.entryNode(childName, childRel, depth+1, entry, info)
+		if child.IsDir {
+			node.Folders[child.Name] = child
+			w.watchDirs(child, childRel, depth+1)
+			changes = append(changes, change{op: statusAdded, rel: childRel + "/"})
+		} else {
+			node.Files = append(node.Files, child)
+			changes = append(changes, change{op: statusAdded, rel: childRel})
+		}
+	}
+	return changes
+}
+
+// entryNode builds the node of a new entry with everything below it.
+func (w *treeWatcher) entryNode(name, rel string, depth int, entry fs.DirEntry, info fs.FileInfo) *FSNode {
+	if entry.IsDir() {
+		f := newFolder(entry.Name())
+		if w.opts.descend(depth) {
+			if err := walkFS(f, w.fsys, name, rel, depth, nil, w.opts); err != nil {
+				f.Err = errText(err)
+			}
+		}
+		return f
+	}
+
+	node, target := fileNode(w.fsys, name, info, w.opts)
+	switch {
+	case target != nil && w.opts.descend(depth):
+		if err := walkFS(node, w.fsys, name, rel, depth, nil, w.opts); err != nil {
+			node.Err = errText(err)
+		}
+	case target == nil && w.opts.archives && isArchive(name) && w.opts.descend(depth):
+		node = walkArchive(w.fsys, name, node, rel, depth, w.opts)
+	}
+	return node
+}
+
+// watchDirs subscribes to f and every directory below it, which is not
+// deeper than the tree. Folders of archives can't be watched, the error
+// is ignored.
+func (w *treeWatcher) watchDirs(f *FSNode, rel string, depth int) {
+	if !w.opts.descend(depth) {
+		return
+	}
+	w.notify.add(rel)
+	for name, folder := range f.Folders {
+		w.watchDirs(folder, joinRel(rel, name), depth+1)
+	}
+}
+
+func (w *treeWatcher) unwatchDirs(f *FSNode, rel string) {
+	for name, folder := range f.Folders {
+		w.unwatchDirs(folder, joinRel(rel, name))
+	}
+	w.notify.remove(rel)
+}
+
+// poller is the fallback notifier: it reports all the directories on
+// every tick, refresh finds out what has changed.
+type poller struct {
+	mu     sync.Mutex
+	dirs   map[string]bool
+	ch     chan string
+	ticker *time.Ticker
+	done   chan struct{}
+}
+
+func newPoller(interval time.Duration) *poller {
+	p := &poller{
+		dirs:   make(map[string]bool),
+		ch:     make(chan string),
+		ticker: time.NewTicker(interval),
+		done:   make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+func (p *poller) run() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-p.ticker.C:
+		}
+
+		p.mu.Lock()
+		dirs := make([]string, 0, len(p.dirs))
+		for rel := range p.dirs {
+			dirs = append(dirs, rel)
+		}
+		p.mu.Unlock()
+
+		for _, rel := range dirs {
+			select {
+			case p.ch <- rel:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+func (p *poller) changes() <-chan string {
+	return p.ch
+}
+
+func (p *poller) add(rel string) error {
+	p.mu.Lock()
+	p.dirs[rel] = true
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *poller) remove(rel string) {
+	p.mu.Lock()
+	delete(p.dirs, rel)
+	p.mu.Unlock()
+}
+
+func (p *poller) close() error {
+	p.ticker.Stop()
+	close(p.done)
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// inotify reports the directory of every event. The descriptor is non
+// blocking, so closing the file stops the pending read. Fd of the file
+// must not be used, it makes the descriptor blocking again.
+type inotify struct {
+	root string
+	fd   int
+	file *os.File
+	ch   chan string
+	done chan struct{}
+
+	mu    sync.Mutex
+	byWd  map[int32]string
+	byRel map[string]int32
+}
+
+func newInotify(root string) (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	n := &inotify{
+		root:  root,
+		fd:    fd,
+		file:  os.NewFile(uintptr(fd), "inotify"),
+		ch:    make(chan string),
+		done:  make(chan struct{}),
+		byWd:  make(map[int32]string),
+		byRel: make(map[string]int32),
+	}
+	go n.run()
+	return n, nil
+}
+
+func (n *inotify) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		size, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= size; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				n.sendAll()
+				continue
+			}
+			n.mu.Lock()
+			rel, ok := n.byWd[event.Wd]
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(n.byWd, event.Wd)
+				if wd, found := n.byRel[rel]; found && wd == event.Wd {
+					delete(n.byRel, rel)
+				}
+			}
+			n.mu.Unlock()
+			if ok && !n.send(rel) {
+				return
+			}
+		}
+	}
+}
+
+func (n *inotify) send(rel string) bool {
+	select {
+	case n.ch <- rel:
+		return true
+	case <-n.done:
+		return false
+	}
+}
+
+// sendAll is used when the kernel queue overflowed and events were lost.
+func (n *inotify) sendAll() {
+	n.mu.Lock()
+	rels := make([]string, 0, len(n.byRel))
+	for rel := range n.byRel {
+		rels = append(rels, rel)
+	}
+	n.mu.Unlock()
+	for _, rel := range rels {
+		if !n.send(rel) {
+			return
+		}
+	}
+}
+
+func (n *inotify) changes() <-chan string {
+	return n.ch
+}
+
+func (n *inotify) add(rel string) error {
+	wd, err := syscall.InotifyAddWatch(n.fd, filepath.Join(n.root, filepath.FromSlash(rel)), inotifyMask)
+	if err != nil {
+		return err
+	}
+	n.mu.Lock()
+	n.byWd[int32(wd)] = rel
+	n.byRel[rel] = int32(wd)
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *inotify) remove(rel string) {
+	n.mu.Lock()
+	wd, ok := n.byRel[rel]
+	delete(n.byRel, rel)
+	if ok {
+		delete(n.byWd, wd)
+	}
+	n.mu.Unlock()
+	if ok {
+		syscall.InotifyRmWatch(n.fd, uint32(wd))
+	}
+}
+
+func (n *inotify) close() error {
+	close(n.done)
+	return n.file.Close()
+}
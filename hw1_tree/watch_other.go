@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func newInotify(root string) (notifier, error) {
+	return nil, errors.New("inotify is not supported, polling is used")
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+)
+
+const defaultCacheLimit = 1024
+
+// signerCache memoizes a signer. Concurrent calls with the same key wait
+// for the first one instead of signing again, and only the limit most
+// recently used results are kept.
+type signerCache struct {
+	sign  func(string) string
+	limit int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	calls   map[string]*signerCall
+}
+
+type cacheEntry struct {
+	key    string
+	result string
+}
+
+type signerCall struct {
+	done   chan struct{}
+	result string
+	ok     bool
+}
+
+func newSignerCache(sign func(string) string, limit int) *signerCache {
+	if limit < 1 {
+		limit = defaultCacheLimit
+	}
+	return &signerCache{
+		sign:    sign,
+		limit:   limit,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		calls:   make(map[string]*signerCall),
+	}
+}
+
+// cacheKey includes the salt, the signers append it to data. The length of
+// data keeps data and salt apart.
+func cacheKey(data string) string {
+	return strconv.Itoa(len(data)) + ":" + data + DataSignerSalt
+}
+
+func (c *signerCache) Sign(data string) string {
+	key := cacheKey(data)
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		c.mu.Unlock()
+		return e.Value.(*cacheEntry).result
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		<-call.done
+		if !call.ok {
+			// the first call panicked, try on our own
+			return c.Sign(data)
+		}
+		return call.result
+	}
+	call := &signerCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+	call.result = c.sign(data)
+	call.ok = true
+
+	c.mu.Lock()
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, result: call.result})
+	if c.lru.Len() > c.limit {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.mu.Unlock()
+	return call.result
+}
+
+// lookup returns the result of data if it is cached, it never signs.
+func (c *signerCache) lookup(data string) (string, bool) {
+	key := cacheKey(data)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(e)
+		return e.Value.(*cacheEntry).result, true
+	}
+	return "", false
+}
+
+// md5Cache is the cache CacheSigners put in front of DataSignerMd5. The md5
+// hasher looks in it before waiting for overheat.
+var md5Cache *signerCache
+
+// CacheSigners puts a cache of up to limit results in front of
+// DataSignerMd5 and DataSignerCrc32. restore brings back the signers as
+// they were.
+func CacheSigners(limit int) (restore func()) {
+	md5, crc32, cache := DataSignerMd5, DataSignerCrc32, md5Cache
+	md5Cache = newSignerCache(md5, limit)
+	DataSignerMd5 = md5Cache.Sign
+	DataSignerCrc32 = newSignerCache(crc32, limit).Sign
+	return func() {
+		DataSignerMd5, DataSignerCrc32, md5Cache = md5, crc32, cache
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	stageSingleHash     = "SingleHash"
+	stageMultiHash      = "MultiHash"
+	stageCombineResults = "CombineResults"
+)
+
+// checkpointRecord is a line of the checkpoint log. The first line holds
+// only the hashes of the salt and of the hmac key and the scheme, the
+// results are worth nothing with others. The salt and the key themselves
+// are never written.
+type checkpointRecord struct {
+	SaltHash string `json:"saltHash,omitempty"`
+	KeyHash  string `json:"keyHash,omitempty"`
+	Scheme   string `json:"scheme,omitempty"`
+	Stage    string `json:"stage,omitempty"`
+	Key      string `json:"key,omitempty"`
+	Input    string `json:"input,omitempty"`
+	Value    string `json:"value,omitempty"`
+}
+
+// Checkpoint is an append only log of the finished items of every stage.
+// Each record is synced before Put returns, so after a crash at most the
+// last line is lost, and it is cut off when the log is opened again.
+type Checkpoint struct {
+	mu      sync.Mutex
+	file    *os.File
+	records map[string]checkpointRecord
+}
+
+// OpenCheckpoint loads the log at path or starts a new one, only the owner
+// can read it, an existing log is made so too. The scheme is the names of the hashers, Scheme.String, and
+// key is the key of hmac-sha256.
+func OpenCheckpoint(path, salt, scheme, key string) (*Checkpoint, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// the mode of OpenFile is only for a new file
+	if err = file.Chmod(0600); err != nil {
+		file.Close()
+		return nil, err
+	}
+	c := &Checkpoint{file: file, records: make(map[string]checkpointRecord)}
+	first := checkpointRecord{SaltHash: fingerprint(salt), KeyHash: fingerprint(key), Scheme: scheme}
+	if err = c.load(first); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("checkpoint %s: %v", path, err)
+	}
+	return c, nil
+}
+
+// fingerprint tells secrets apart without keeping them. It is hmac-sha256
+// keyed by the secret rather than its plain sha256, which a short secret
+// could be looked up by.
+func fingerprint(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("signer-checkpoint"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (c *Checkpoint) load(identity checkpointRecord) error {
+	var good int64
+	reader := bufio.NewReader(c.file)
+	first := true
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// an unfinished line is what a crash in the middle of Put leaves
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var record checkpointRecord
+		if err = json.Unmarshal(bytes.TrimSpace(line), &record); err != nil {
+			return fmt.Errorf("broken record at %d: %v", good, err)
+		}
+		if first {
+			if record.SaltHash == "" || record.KeyHash == "" {
+				return fmt.Errorf("no salt or key hash in the first record")
+			}
+			if record.SaltHash != identity.SaltHash {
+				return fmt.Errorf("made with another salt")
+			}
+			if record.KeyHash != identity.KeyHash {
+				return fmt.Errorf("made with another hmac key")
+			}
+			if record.Scheme != identity.Scheme {
+				return fmt.Errorf("made with scheme %s, not %s", record.Scheme, identity.Scheme)
+			}
+			first = false
+		} else {
+			c.records[recordKey(record.Stage, record.Key)] = record
+		}
+		good += int64(len(line))
+	}
+
+	if err := c.file.Truncate(good); err != nil {
+		return err
+	}
+	if _, err := c.file.Seek(good, io.SeekStart); err != nil {
+		return err
+	}
+	if first {
+		return c.write(identity)
+	}
+	return nil
+}
+
+func recordKey(stage, key string) string {
+	return stage + "\x00" + key
+}
+
+func (c *Checkpoint) write(record checkpointRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err = c.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return c.file.Sync()
+}
+
+// Get returns the result of the item key of the stage. The input it was
+// made of has to be the same, otherwise the input has changed since the
+// checkpoint and it fails.
+func (c *Checkpoint) Get(stage, key, input string) (string, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	record, ok := c.records[recordKey(stage, key)]
+	if !ok {
+		return "", false, nil
+	}
+	if record.Input != input {
+		return "", false, fmt.Errorf("%s of %s was made of %q, now it is %q", stage, key, record.Input, input)
+	}
+	return record.Value, true, nil
+}
+
+// Put records the result of the item, a result which is already there is
+// not written again.
+func (c *Checkpoint) Put(stage, key, input, value string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.records[recordKey(stage, key)]; ok {
+		return nil
+	}
+	record := checkpointRecord{Stage: stage, Key: key, Input: input, Value: value}
+	if err := c.write(record); err != nil {
+		return err
+	}
+	c.records[recordKey(stage, key)] = record
+	return nil
+}
+
+func (c *Checkpoint) Close() error {
+	return c.file.Close()
+}
+
+// checkpointed returns the result of the item from the checkpoint, or
+// computes and records it.
+func checkpointed(c *Checkpoint, stage, key, input string, compute func() (string, error)) (string, error) {
+	if c == nil {
+		return compute()
+	}
+	if value, ok, err := c.Get(stage, key, input); ok || err != nil {
+		return value, err
+	}
+	value, err := compute()
+	if err != nil {
+		return "", err
+	}
+	return value, c.Put(stage, key, input, value)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"hash/crc32"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -20,26 +21,28 @@ var (
 	DataSignerSalt            = ""
 )
 
+// overheat lets one DataSignerMd5 call run at a time, the rest wait for
+// their turn. An exclusive Hasher takes a place with the ctx of its caller
+// before calling the signer, so its calls never wait in OverheatLock.
+var overheat = NewSemaphore(1)
+
+// overheatFree wakes the callers of DataSignerMd5 which are not kept apart
+// by overheat, they wait in OverheatLock for the running call.
+var overheatFree = sync.NewCond(&sync.Mutex{})
+
 var OverheatLock = func() {
-	for {
-		if swapped := atomic.CompareAndSwapUint32(&dataSignerOverheat, 0, 1); !swapped {
-			fmt.Println("OverheatLock happend")
-			time.Sleep(time.Second)
-		} else {
-			break
-		}
+	overheatFree.L.Lock()
+	defer overheatFree.L.Unlock()
+	for !atomic.CompareAndSwapUint32(&dataSignerOverheat, 0, 1) {
+		overheatFree.Wait()
 	}
 }
 
 var OverheatUnlock = func() {
-	for {
-		if swapped := atomic.CompareAndSwapUint32(&dataSignerOverheat, 1, 0); !swapped {
-			fmt.Println("OverheatUnlock happend")
-			time.Sleep(time.Second)
-		} else {
-			break
-		}
-	}
+	overheatFree.L.Lock()
+	atomic.StoreUint32(&dataSignerOverheat, 0)
+	overheatFree.L.Unlock()
+	overheatFree.Signal()
 }
 
 var DataSignerMd5 = func(data string) string {
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Graph is a pipeline of named nodes, every node reads from the nodes it
+// is built from. Only Broadcast and Partition may be read by more than one
+// node, the output nobody reads is drained.
+type Graph struct {
+	nodes  []*graphNode
+	byName map[string]*graphNode
+	err    error
+}
+
+type graphNode struct {
+	name string
+	from []string
+	// ports is the number of outputs, 0 means one for every reader
+	ports int
+	run   func(ctx context.Context, ins, outs []chan interface{}) error
+}
+
+// NodeError is the first failure of a graph.
+type NodeError struct {
+	Node string
+	Err  error
+}
+
+func (e *NodeError) Error() string {
+	return fmt.Sprintf("node %q: %v", e.Node, e.Err)
+}
+
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
+
+func NewGraph() *Graph {
+	return &Graph{byName: make(map[string]*graphNode)}
+}
+
+// Port is the name of an output of a Partition node.
+func Port(name string, i int) string {
+	return name + "[" + strconv.Itoa(i) + "]"
+}
+
+var portRe = regexp.MustCompile(`^(.*)\[(\d+)\]$`)
+
+func (g *Graph) add(node *graphNode) {
+	if _, ok := g.byName[node.name]; ok && g.err == nil {
+		g.err = fmt.Errorf("node %q added twice", node.name)
+	}
+	g.byName[node.name] = node
+	g.nodes = append(g.nodes, node)
+}
+
+// Job adds a node running j, without from it is a source.
+func (g *Graph) Job(name string, j ctxJob, from ...string) {
+	if len(from) > 1 && g.err == nil {
+		g.err = fmt.Errorf("node %q has more than one input, use Merge", name)
+	}
+	g.add(&graphNode{name: name, from: from, ports: 1, run: func(ctx context.Context, ins, outs []chan interface{}) error {
+		return runJob(ctx, j, ins[0], outs[0])
+	}})
+}
+
+// Broadcast sends every item to every node reading from it.
+func (g *Graph) Broadcast(name, from string) {
+	g.add(&graphNode{name: name, from: []string{from}, run: func(ctx context.Context, ins, outs []chan interface{}) error {
+		for v := range ins[0] {
+			for _, out := range outs {
+				if send(ctx, out, v) != nil {
+					return nil
+				}
+			}
+		}
+		return nil
+	}})
+}
+
+// Partition sends every item to the port key returns, the ports are
+// named by Port(name, 0) to Port(name, n-1).
+func (g *Graph) Partition(name, from string, n int, key func(interface{}) int) {
+	if n < 1 && g.err == nil {
+		g.err = fmt.Errorf("node %q has no ports", name)
+	}
+	g.add(&graphNode{name: name, from: []string{from}, ports: n, run: func(ctx context.Context, ins, outs []chan interface{}) error {
+		for v := range ins[0] {
+			i := key(v)
+			if i < 0 || i >= len(outs) {
+				return fmt.Errorf("no port %d for %v", i, v)
+			}
+			if send(ctx, outs[i], v) != nil {
+				return nil
+			}
+		}
+		return nil
+	}})
+}
+
+// Merge sends on the items of all its inputs as they come.
+func (g *Graph) Merge(name string, from ...string) {
+	g.add(&graphNode{name: name, from: from, ports: 1, run: func(ctx context.Context, ins, outs []chan interface{}) error {
+		wg := &sync.WaitGroup{}
+		for _, in := range ins {
+			wg.Add(1)
+			go func(in chan interface{}) {
+				defer wg.Done()
+				for v := range in {
+					if send(ctx, outs[0], v) != nil {
+						return
+					}
+				}
+			}(in)
+		}
+		wg.Wait()
+		return nil
+	}})
+}
+
+// Window sends the items as []interface{} batches of size items, or less
+// if every has passed since the first item of the batch. Either of them
+// may be zero, the rest of the items is sent when the input is over.
+func (g *Graph) Window(name, from string, size int, every time.Duration) {
+	g.add(&graphNode{name: name, from: []string{from}, ports: 1, run: func(ctx context.Context, ins, outs []chan interface{}) error {
+		var batch []interface{}
+		var timer *time.Timer
+		var tick <-chan time.Time
+		flush := func() error {
+			if timer != nil {
+				timer.Stop()
+				timer, tick = nil, nil
+			}
+			if len(batch) == 0 {
+				return nil
+			}
+			err := send(ctx, outs[0], batch)
+			batch = nil
+			return err
+		}
+
+		for {
+			select {
+			case v, ok := <-ins[0]:
+				if !ok {
+					flush()
+					return nil
+				}
+				batch = append(batch, v)
+				if len(batch) == 1 && every > 0 {
+					timer = time.NewTimer(every)
+					tick = timer.C
+				}
+				if size > 0 && len(batch) >= size && flush() != nil {
+					return nil
+				}
+			case <-tick:
+				timer, tick = nil, nil
+				if flush() != nil {
+					return nil
+				}
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}})
+}
+
+// eachItem is a job calling f for every item in its own goroutine, the
+// results are sent as they are ready.
+func eachItem(f itemFunc) ctxJob {
+	return func(ctx context.Context, in, out chan interface{}) error {
+		var once sync.Once
+		var firstErr error
+		wg := &sync.WaitGroup{}
+		for v := range in {
+			wg.Add(1)
+			go func(v interface{}) {
+				defer wg.Done()
+				result, err := runItem(ctx, f, v)
+				if err == nil {
+					err = send(ctx, out, result)
+				}
+				if err != nil {
+					once.Do(func() {
+						firstErr = err
+					})
+				}
+			}(v)
+		}
+		wg.Wait()
+		return firstErr
+	}
+}
+
+// resolve finds the node and the port behind a name used in from.
+func (g *Graph) resolve(name string) (*graphNode, int, error) {
+	if node, ok := g.byName[name]; ok {
+		return node, 0, nil
+	}
+	if m := portRe.FindStringSubmatch(name); m != nil {
+		if node, ok := g.byName[m[1]]; ok && node.ports > 1 {
+			port, _ := strconv.Atoi(m[2])
+			if port < node.ports {
+				return node, port, nil
+			}
+		}
+	}
+	return nil, 0, fmt.Errorf("unknown node %q", name)
+}
+
+// Validate checks that every input exists, the outputs are not shared and
+// there are no cycles.
+func (g *Graph) Validate() error {
+	if g.err != nil {
+		return g.err
+	}
+	readers := make(map[string]int)
+	for _, node := range g.nodes {
+		if node.ports > 1 && len(node.from) != 1 {
+			return fmt.Errorf("node %q needs one input", node.name)
+		}
+		for _, from := range node.from {
+			source, port, err := g.resolve(from)
+			if err != nil {
+				return fmt.Errorf("node %q: %v", node.name, err)
+			}
+			if source.ports == 0 {
+				continue
+			}
+			key := Port(source.name, port)
+			if readers[key]++; readers[key] > 1 {
+				return fmt.Errorf("node %q: %q is read by another node, use Broadcast", node.name, from)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*graphNode]int)
+	var visit func(node *graphNode, path []string) error
+	visit = func(node *graphNode, path []string) error {
+		switch state[node] {
+		case visiting:
+			return fmt.Errorf("cycle: %v", append(path, node.name))
+		case visited:
+			return nil
+		}
+		state[node] = visiting
+		for _, from := range node.from {
+			source, _, _ := g.resolve(from)
+			if err := visit(source, append(path, node.name)); err != nil {
+				return err
+			}
+		}
+		state[node] = visited
+		return nil
+	}
+	for _, node := range g.nodes {
+		if err := visit(node, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run validates the graph and runs all its nodes until they return. Like
+// ExecutePipelineContext, the first error cancels the other nodes and the
+// inputs of a node are drained after it returns.
+func (g *Graph) Run(ctx context.Context) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	ins := make(map[*graphNode][]chan interface{})
+	outs := make(map[*graphNode][][]chan interface{})
+	for _, node := range g.nodes {
+		ports := node.ports
+		if ports == 0 {
+			ports = 1
+		}
+		outs[node] = make([][]chan interface{}, ports)
+	}
+	for _, node := range g.nodes {
+		if len(node.from) == 0 {
+			in := make(chan interface{})
+			close(in)
+			ins[node] = []chan interface{}{in}
+			continue
+		}
+		for _, from := range node.from {
+			source, port, _ := g.resolve(from)
+			ch := make(chan interface{}, stageBuffer)
+			ins[node] = append(ins[node], ch)
+			outs[source][port] = append(outs[source][port], ch)
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	for _, node := range g.nodes {
+		var nodeOuts []chan interface{}
+		for port, chans := range outs[node] {
+			if len(chans) == 0 {
+				// nobody reads it
+				ch := make(chan interface{}, stageBuffer)
+				outs[node][port] = []chan interface{}{ch}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range ch {
+					}
+				}()
+			}
+			nodeOuts = append(nodeOuts, outs[node][port]...)
+		}
+
+		wg.Add(1)
+		go func(node *graphNode, ins, outs []chan interface{}) {
+			defer wg.Done()
+			if err := runNode(ctx, node, ins, outs); err != nil {
+				fail(&NodeError{Node: node.name, Err: err})
+			}
+			for _, out := range outs {
+				close(out)
+			}
+			// at once, a Broadcast can be blocked on any of them
+			for _, in := range ins {
+				wg.Add(1)
+				go func(in chan interface{}) {
+					defer wg.Done()
+					for range in {
+					}
+				}(in)
+			}
+		}(node, ins[node], nodeOuts)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+func runNode(ctx context.Context, node *graphNode, ins, outs []chan interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return node.run(ctx, ins, outs)
+}
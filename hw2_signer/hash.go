@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Hasher is an algorithm of the signer chain.
+type Hasher struct {
+	Name string
+	Sign func(data string) string
+	// Exclusive hashers run one call at a time, like md5 which overheats.
+	// They share overheat, the limiter of DataSignerMd5.
+	Exclusive bool
+	// Latency is how long a call takes, Estimate is based on it.
+	Latency time.Duration
+	// cache is looked in before an exclusive call waits for its turn.
+	cache *signerCache
+}
+
+// Scheme is the signer chain: SingleHash is Outer(data)+"~"+Outer(Inner(data))
+// and MultiHash joins Multi(th+data) for th from 0 to Threads-1.
+type Scheme struct {
+	Outer, Inner, Multi Hasher
+	Threads             int
+}
+
+// LegacyScheme is crc32 and md5 of the course, with DataSignerCrc32 and
+// DataSignerMd5 as they are when it is called.
+func LegacyScheme() Scheme {
+	crc32 := Hasher{Name: "crc32", Sign: DataSignerCrc32, Latency: time.Second}
+	return Scheme{
+		Outer:   crc32,
+		Inner:   Hasher{Name: "md5", Sign: DataSignerMd5, Exclusive: true, Latency: 10 * time.Millisecond, cache: md5Cache},
+		Multi:   crc32,
+		Threads: 6,
+	}
+}
+
+// String is the names of the hashers as ParseScheme takes them.
+func (s Scheme) String() string {
+	return s.Outer.Name + "," + s.Inner.Name + "," + s.Multi.Name
+}
+
+// Estimate is the time the scheme takes to sign items numbers, workers of
+// them at once. The calls of an exclusive hasher wait for each other.
+func (s Scheme) Estimate(items, workers int) time.Duration {
+	if items < 1 {
+		return 0
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	single := s.Outer.Latency
+	if inner := s.Inner.Latency + s.Outer.Latency; inner > single {
+		single = inner
+	}
+	rounds := time.Duration((items + workers - 1) / workers)
+	estimate := rounds * (single + s.Multi.Latency)
+
+	var queued time.Duration
+	for _, h := range []Hasher{s.Outer, s.Inner} {
+		if h.Exclusive {
+			queued += h.Latency
+		}
+	}
+	if s.Multi.Exclusive {
+		queued += time.Duration(s.Threads) * s.Multi.Latency
+	}
+	return estimate + time.Duration(items-1)*queued
+}
+
+type schemeKey struct{}
+
+// WithScheme makes the stages sign with s instead of LegacyScheme.
+func WithScheme(ctx context.Context, s Scheme) context.Context {
+	return context.WithValue(ctx, schemeKey{}, s)
+}
+
+func schemeFrom(ctx context.Context) Scheme {
+	if s, ok := ctx.Value(schemeKey{}).(Scheme); ok {
+		return s
+	}
+	return LegacyScheme()
+}
+
+// NewHasher makes a hasher of the library by name: crc32 and md5 are the
+// legacy signers, sha256, sha512, blake2b (256 bits), xxhash (64 bits) and
+// fnv64a hash data with the salt, hmac-sha256 signs it with key. All of
+// them but the legacy ones are instant.
+func NewHasher(name, key string) (Hasher, error) {
+	switch name {
+	case "crc32":
+		return LegacyScheme().Outer, nil
+	case "md5":
+		return LegacyScheme().Inner, nil
+	case "sha256":
+		return Hasher{Name: name, Sign: hashSigner(sha256.New)}, nil
+	case "sha512":
+		return Hasher{Name: name, Sign: hashSigner(sha512.New)}, nil
+	case "blake2b":
+		return Hasher{Name: name, Sign: hashSigner(func() hash.Hash {
+			h, _ := blake2b.New256(nil) // fails only for a long key
+			return h
+		})}, nil
+	case "xxhash":
+		return Hasher{Name: name, Sign: hashSigner(func() hash.Hash { return xxhash.New() })}, nil
+	case "fnv64a":
+		return Hasher{Name: name, Sign: hashSigner(func() hash.Hash { return fnv.New64a() })}, nil
+	case "hmac-sha256":
+		if key == "" {
+			return Hasher{}, fmt.Errorf("%s needs a key", name)
+		}
+		return Hasher{Name: name, Sign: hashSigner(func() hash.Hash {
+			return hmac.New(sha256.New, []byte(key))
+		})}, nil
+	}
+	return Hasher{}, fmt.Errorf("unknown hasher %q", name)
+}
+
+func hashSigner(newHash func() hash.Hash) func(string) string {
+	return func(data string) string {
+		h := newHash()
+		h.Write([]byte(data + DataSignerSalt))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+// ParseScheme takes the outer, inner and multi hashers by name, separated by
+// commas: "crc32,md5,crc32" is LegacyScheme. Threads stays 6.
+func ParseScheme(names, key string) (Scheme, error) {
+	parts := strings.Split(names, ",")
+	if len(parts) != 3 {
+		return Scheme{}, fmt.Errorf("scheme %q needs outer, inner and multi hashers", names)
+	}
+	var hashers [3]Hasher
+	for i, name := range parts {
+		h, err := NewHasher(strings.TrimSpace(name), key)
+		if err != nil {
+			return Scheme{}, err
+		}
+		hashers[i] = h
+	}
+	return Scheme{Outer: hashers[0], Inner: hashers[1], Multi: hashers[2], Threads: 6}, nil
+}
+
+// call signs data within a span named span. An exclusive hasher waits for
+// overheat with ctx and holds it until the signer is over, even if ctx is
+// done meanwhile. A result in its cache doesn't wait.
+func (h Hasher) call(ctx context.Context, span, data string) (string, error) {
+	if !h.Exclusive {
+		return sign(ctx, span, h.Sign, data)
+	}
+	if h.cache != nil {
+		if result, ok := h.cache.lookup(data); ok {
+			return sign(ctx, span, func(string) string { return result }, data)
+		}
+	}
+	if err := overheat.Acquire(ctx); err != nil {
+		return "", err
+	}
+	signer := h.Sign
+	return sign(ctx, span, func(data string) string {
+		defer overheat.Release()
+		return signer(data)
+	}, data)
+}
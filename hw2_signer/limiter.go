@@ -0,0 +1,105 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// Semaphore lets up to size holders in at once. The others wait in a queue
+// and get in in the order they came.
+type Semaphore struct {
+	mu      sync.Mutex
+	size    int
+	held    int
+	waiters list.List
+	stats   LimiterStats
+}
+
+// LimiterStats tell how long Acquire had to wait.
+type LimiterStats struct {
+	Acquired int
+	Waited   int
+	WaitTime time.Duration
+	MaxWait  time.Duration
+}
+
+func NewSemaphore(size int) *Semaphore {
+	if size < 1 {
+		size = 1
+	}
+	return &Semaphore{size: size}
+}
+
+// Acquire blocks until the semaphore lets the caller in or ctx is done.
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	s.mu.Lock()
+	if s.held < s.size && s.waiters.Len() == 0 {
+		s.held++
+		s.stats.Acquired++
+		s.mu.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	e := s.waiters.PushBack(ready)
+	s.mu.Unlock()
+
+	start := time.Now()
+	select {
+	case <-ready:
+		s.record(time.Since(start))
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		select {
+		case <-ready:
+			// let in meanwhile, pass it on
+			s.mu.Unlock()
+			s.Release()
+		default:
+			s.waiters.Remove(e)
+			s.mu.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+func (s *Semaphore) record(wait time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats.Acquired++
+	s.stats.Waited++
+	s.stats.WaitTime += wait
+	if wait > s.stats.MaxWait {
+		s.stats.MaxWait = wait
+	}
+}
+
+// Release lets the first waiter in.
+func (s *Semaphore) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held == 0 {
+		panic("semaphore: released more than acquired")
+	}
+	if front := s.waiters.Front(); front != nil {
+		// the place goes to the waiter, held stays the same
+		s.waiters.Remove(front)
+		close(front.Value.(chan struct{}))
+		return
+	}
+	s.held--
+}
+
+func (s *Semaphore) waiting() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiters.Len()
+}
+
+func (s *Semaphore) Stats() LimiterStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stats
+}
@@ -1,5 +1,251 @@
 package main
 
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const usage = `usage: go run . [--salt SALT] [--workers N] [--stream] [--checkpoint FILE]
+		[--scheme OUTER,INNER,MULTI] [--hmac-key KEY] [FILE...]
+	reads a number per line from the files or stdin and prints the combined hash,
+	--stream prints the hashes of every number as NDJSON in the input order,
+	--checkpoint records the finished hashes, a run with the same file skips them,
+	--scheme takes crc32, md5, sha256, sha512, blake2b, xxhash, fnv64a
+		or hmac-sha256 with --hmac-key`
+
+// saltEnv is used when --salt is not given.
+const saltEnv = "SIGNER_SALT"
+
 func main() {
-	println("run as\n\ngo test -v -race")
+	opts, files, err := parseArgs(os.Args[1:], os.Getenv)
+	if err != nil {
+		panic(usage)
+	}
+	if err = run(context.Background(), os.Stdout, os.Stdin, files, opts); err != nil {
+		panic(err.Error())
+	}
+}
+
+type options struct {
+	salt    string
+	workers int
+	stream  bool
+	// checkpoint is the path of the checkpoint log, none if empty
+	checkpoint string
+	scheme     Scheme
+	// key is the key of hmac-sha256, the checkpoint keeps only its hash
+	key string
+}
+
+// parseArgs accepts flags both before and after the files.
+func parseArgs(args []string, getenv func(string) string) (*options, []string, error) {
+	opts := &options{}
+	flags := flag.NewFlagSet("signer", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.StringVar(&opts.salt, "salt", getenv(saltEnv), "salt of the signers, $"+saltEnv+" by default")
+	flags.IntVar(&opts.workers, "workers", stageBuffer, "numbers hashed at once")
+	flags.BoolVar(&opts.stream, "stream", false, "print the hashes of every number as NDJSON")
+	flags.StringVar(&opts.checkpoint, "checkpoint", "", "file to record the finished hashes in and resume from")
+	scheme := flags.String("scheme", LegacyScheme().String(), "outer, inner and multi hashers")
+	flags.StringVar(&opts.key, "hmac-key", "", "key of hmac-sha256")
+
+	var files []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, nil, err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		files = append(files, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	if opts.workers < 1 {
+		return nil, nil, fmt.Errorf("workers must be positive, got %d", opts.workers)
+	}
+	var err error
+	if opts.scheme, err = ParseScheme(*scheme, opts.key); err != nil {
+		return nil, nil, err
+	}
+	return opts, files, nil
+}
+
+// signedLine is a line of the --stream output.
+type signedLine struct {
+	File       string `json:"file,omitempty"`
+	Line       int    `json:"line"`
+	Value      int    `json:"value"`
+	SingleHash string `json:"singleHash"`
+	MultiHash  string `json:"multiHash"`
+}
+
+// key names the line in the checkpoint.
+func (l signedLine) key() string {
+	name := l.File
+	if name == "" {
+		name = "stdin"
+	}
+	return name + ":" + strconv.Itoa(l.Line)
+}
+
+func run(ctx context.Context, out io.Writer, stdin io.Reader, files []string, opts *options) error {
+	DataSignerSalt = opts.salt
+	var checkpoint *Checkpoint
+	if opts.checkpoint != "" {
+		var err error
+		if checkpoint, err = OpenCheckpoint(opts.checkpoint, opts.salt, opts.scheme.String(), opts.key); err != nil {
+			return err
+		}
+		defer checkpoint.Close()
+	}
+	legacy := opts.scheme.String() == LegacyScheme().String()
+	reader := readNumbers(stdin, files, opts.stream || checkpoint != nil || !legacy)
+	ctx = WithScheme(ctx, opts.scheme)
+
+	if !opts.stream && checkpoint == nil && legacy {
+		return ExecuteStages(ctx,
+			StageConfig{Job: reader},
+			StageConfig{Job: job(SingleHash).withContext(), MaxInFlight: opts.workers},
+			StageConfig{Job: job(MultiHash).withContext(), MaxInFlight: opts.workers},
+			StageConfig{Job: job(CombineResults).withContext()},
+			printResults(out),
+		)
+	}
+
+	stages := []StageConfig{
+		{Job: reader},
+		{
+			Item: typedItemErr(func(ctx context.Context, line signedLine) (signedLine, error) {
+				var err error
+				line.SingleHash, err = checkpointed(checkpoint, stageSingleHash, line.key(), strconv.Itoa(line.Value), func() (string, error) {
+					return singleHashItem(ctx, line.Value)
+				})
+				return line, err
+			}),
+			Ordered:     true,
+			Workers:     opts.workers,
+			MaxInFlight: opts.workers,
+		},
+		{
+			Item: typedItemErr(func(ctx context.Context, line signedLine) (signedLine, error) {
+				var err error
+				line.MultiHash, err = checkpointed(checkpoint, stageMultiHash, line.key(), line.SingleHash, func() (string, error) {
+					return multiHashItem(ctx, line.SingleHash)
+				})
+				return line, err
+			}),
+			Ordered:     true,
+			Workers:     opts.workers,
+			MaxInFlight: opts.workers,
+		},
+	}
+	if opts.stream {
+		stages = append(stages, StageConfig{Job: func(ctx context.Context, in, _ chan interface{}) error {
+			encoder := json.NewEncoder(out)
+			for line := range in {
+				if err := encoder.Encode(line); err != nil {
+					return err
+				}
+			}
+			return nil
+		}})
+	} else {
+		stages = append(stages, StageConfig{Job: combineCheckpoint(checkpoint)}, printResults(out))
+	}
+	return ExecuteStages(ctx, stages...)
+}
+
+// combineCheckpoint is CombineResults of the lines. The result is recorded
+// once, a run over a finished checkpoint sends the recorded one, and fails
+// if the number of lines is not the same.
+func combineCheckpoint(checkpoint *Checkpoint) ctxJob {
+	return func(ctx context.Context, in, out chan interface{}) error {
+		var sl []string
+		for v := range in {
+			sl = append(sl, v.(signedLine).MultiHash)
+		}
+		// the input is over early if a stage before has failed
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		result, err := checkpointed(checkpoint, stageCombineResults, "result", strconv.Itoa(len(sl)), func() (string, error) {
+			sort.Strings(sl)
+			return strings.Join(sl, "_"), nil
+		})
+		if err != nil {
+			return err
+		}
+		return send(ctx, out, result)
+	}
+}
+
+// printResults is the last stage, it prints a result per line.
+func printResults(out io.Writer) StageConfig {
+	return StageConfig{Job: func(ctx context.Context, in, _ chan interface{}) error {
+		for result := range in {
+			if _, err := fmt.Fprintln(out, result); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+}
+
+// readNumbers is the first job, it sends a number for every non empty line
+// of the files, or of stdin if there are none. With lines it sends
+// signedLine instead of int, File is empty for stdin.
+func readNumbers(stdin io.Reader, files []string, lines bool) ctxJob {
+	return func(ctx context.Context, _, out chan interface{}) error {
+		if len(files) == 0 {
+			return scanNumbers(ctx, stdin, "", lines, out)
+		}
+		for _, name := range files {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			err = scanNumbers(ctx, f, name, lines, out)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func scanNumbers(ctx context.Context, r io.Reader, name string, lines bool, out chan interface{}) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		num, err := strconv.Atoi(text)
+		if err != nil {
+			where := name
+			if where == "" {
+				where = "stdin"
+			}
+			return fmt.Errorf("%s:%d: %q is not a number", where, n, text)
+		}
+
+		var v interface{} = num
+		if lines {
+			v = signedLine{File: name, Line: n, Value: num}
+		}
+		if err = send(ctx, out, v); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
 }
@@ -1,13 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
 	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"hash/crc32"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"golang.org/x/crypto/blake2b"
 )
 
 /*
@@ -147,3 +166,1463 @@ func TestSigner(t *testing.T) {
 	}
 
 }
+
+func TestTypedSigner(t *testing.T) {
+	testExpected := "1173136728138862632818075107442090076184424490584241521304_1696913515191343735512658979631549563179965036907783101867_27225454331033649287118297354036464389062965355426795162684_29568666068035183841425683795340791879727309630931025356555_3994492081516972096677631278379039212655368881548151736_4958044192186797981418233587017209679042592862002427381542_4958044192186797981418233587017209679042592862002427381542"
+	var results []string
+
+	inputData := []int{0, 1, 1, 2, 3, 5, 8}
+	signer := Pipe(Pipe(Pipe(Source(inputData...), singleHash), multiHash), combineResults)
+
+	start := time.Now()
+	Run(signer, func(result string) {
+		results = append(results, result)
+	})
+	end := time.Since(start)
+
+	if len(results) != 1 || results[0] != testExpected {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", results, testExpected)
+	}
+	if end > 3*time.Second {
+		t.Errorf("execition too long\nGot: %s\nExpected: <%s", end, time.Second*3)
+	}
+}
+
+func TestHashLimit(t *testing.T) {
+	crc32 := DataSignerCrc32
+	defer func() {
+		DataSignerCrc32 = crc32
+	}()
+	var active, peak int32
+	DataSignerCrc32 = func(data string) string {
+		n := atomic.AddInt32(&active, 1)
+		for p := atomic.LoadInt32(&peak); n > p && !atomic.CompareAndSwapInt32(&peak, p, n); p = atomic.LoadInt32(&peak) {
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+		return data
+	}
+
+	var data []string
+	for i := 0; i < 3*MaxInputDataLen; i++ {
+		data = append(data, strconv.Itoa(i))
+	}
+	var results int
+	Run(Pipe(Source(data...), multiHash), func(string) {
+		results++
+	})
+	if results != len(data) || peak > 6*MaxInputDataLen {
+		t.Errorf("results not match\nGot: %d results, %d calls at once\nExpected: %d results, up to %d calls", results, peak, len(data), 6*MaxInputDataLen)
+	}
+}
+
+func TestTypedPipeline(t *testing.T) {
+	var recieved uint32
+	ok := true
+	first := Stage[struct{}, int](func(in <-chan struct{}, out chan<- int) {
+		out <- 1
+		time.Sleep(10 * time.Millisecond)
+		if atomic.LoadUint32(&recieved) == 0 {
+			ok = false
+		}
+	})
+	Run(first, func(int) {
+		atomic.AddUint32(&recieved, 1)
+	})
+	if !ok {
+		t.Errorf("no value free flow - dont collect them")
+	}
+}
+
+func TestJobAdapter(t *testing.T) {
+	double := job(func(in, out chan interface{}) {
+		for v := range in {
+			out <- v.(int) * 2
+		}
+	})
+	var got []int
+	Run(Pipe(Source(1, 2, 3), FromJob[int, int](double)), func(v int) {
+		got = append(got, v)
+	})
+	if fmt.Sprint(got) != "[2 4 6]" {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", got, "[2 4 6]")
+	}
+
+	got = nil
+	ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			out <- 5
+		}),
+		Stage[int, int](func(in <-chan int, out chan<- int) {
+			for v := range in {
+				out <- v + 1
+			}
+		}).job(),
+		job(func(in, out chan interface{}) {
+			for v := range in {
+				got = append(got, v.(int))
+			}
+		}),
+	)
+	if fmt.Sprint(got) != "[6]" {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", got, "[6]")
+	}
+}
+
+func TestJobAdapterWrongType(t *testing.T) {
+	for _, c := range []struct {
+		stage    job
+		expected string
+	}{
+		{job(SingleHash), "pipeline: expected int, got string"},
+		{FromJob[int, int](job(func(in, out chan interface{}) {
+			for range in {
+				out <- "1"
+			}
+		})).job(), "pipeline: expected int, got string"},
+	} {
+		func() {
+			defer func() {
+				if r := recover(); r != c.expected {
+					t.Errorf("results not match\nGot: %v\nExpected: %v", r, c.expected)
+				}
+			}()
+			ExecutePipeline(
+				job(func(_, out chan interface{}) {
+					out <- "x"
+				}),
+				c.stage,
+				job(func(in, out chan interface{}) {
+					for range in {
+					}
+				}),
+			)
+			t.Errorf("no panic")
+		}()
+	}
+}
+
+func TestJobAdapterEarlyReturn(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ExecutePipeline(
+		job(func(_, out chan interface{}) {
+			for i := 0; i < 10*stageBuffer; i++ {
+				out <- i
+			}
+		}),
+		Stage[int, int](func(in <-chan int, out chan<- int) {
+			out <- <-in
+		}).job(),
+		job(func(in, out chan interface{}) {
+			for range in {
+			}
+		}),
+	)
+	checkLeaks(t, before)
+}
+
+// checkLeaks fails the test if goroutines started after before are still
+// running a moment later.
+func checkLeaks(t *testing.T, before int) {
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Errorf("goroutines leaked\nGot: %d\nExpected: %d", runtime.NumGoroutine(), before)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// endless sends numbers until ctx is done.
+func endless(ctx context.Context, in, out chan interface{}) error {
+	for i := 0; ; i++ {
+		if err := send(ctx, out, i); err != nil {
+			return nil
+		}
+	}
+}
+
+func TestPipelineError(t *testing.T) {
+	before := runtime.NumGoroutine()
+	errBroken := errors.New("broken")
+	var recieved uint32
+
+	err := ExecutePipelineContext(context.Background(),
+		endless,
+		func(ctx context.Context, in, out chan interface{}) error {
+			for v := range in {
+				if v.(int) == 10 {
+					return errBroken
+				}
+				if err := send(ctx, out, v); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func(ctx context.Context, in, out chan interface{}) error {
+			for range in {
+				atomic.AddUint32(&recieved, 1)
+			}
+			return nil
+		},
+	)
+
+	var stageErr *StageError
+	if !errors.As(err, &stageErr) || stageErr.Stage != 1 || !errors.Is(err, errBroken) {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", err, "stage 1: broken")
+	}
+	if recieved != 10 {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", recieved, 10)
+	}
+	checkLeaks(t, before)
+}
+
+func TestPipelineCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := ExecutePipelineContext(ctx,
+		endless,
+		job(func(in, out chan interface{}) {
+			for v := range in {
+				out <- v
+			}
+		}).withContext(),
+		func(ctx context.Context, in, out chan interface{}) error {
+			// stops reading early, the jobs before it must not get stuck
+			<-in
+			return nil
+		},
+	)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", err, context.DeadlineExceeded)
+	}
+	checkLeaks(t, before)
+}
+
+func TestPipelinePanic(t *testing.T) {
+	before := runtime.NumGoroutine()
+	err := ExecutePipelineContext(context.Background(),
+		endless,
+		func(ctx context.Context, in, out chan interface{}) error {
+			for v := range in {
+				_ = v.(string)
+			}
+			return nil
+		},
+	)
+	var stageErr *StageError
+	if !errors.As(err, &stageErr) || stageErr.Stage != 1 {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", err, "stage 1: panic")
+	}
+	checkLeaks(t, before)
+}
+
+func TestExecutePipelinePanic(t *testing.T) {
+	before := runtime.NumGoroutine()
+	defer func() {
+		if r := recover(); r != "broken job" {
+			t.Errorf("results not match\nGot: %v\nExpected: %v", r, "broken job")
+		}
+		checkLeaks(t, before)
+	}()
+	ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			for i := 0; i < 10; i++ {
+				out <- i
+			}
+		}),
+		job(func(in, out chan interface{}) {
+			for range in {
+				panic("broken job")
+			}
+		}),
+	)
+	t.Errorf("no panic")
+}
+
+func TestExecutePipelineSignerPanic(t *testing.T) {
+	crc32 := DataSignerCrc32
+	defer func() {
+		DataSignerCrc32 = crc32
+	}()
+	DataSignerCrc32 = func(data string) string {
+		panic("crc32 is broken")
+	}
+	testCases := []struct {
+		name  string
+		input interface{}
+		job   job
+	}{
+		{"SingleHash", 1, job(SingleHash)},
+		{"MultiHash", "1", job(MultiHash)},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			before := runtime.NumGoroutine()
+			defer func() {
+				err, _ := recover().(error)
+				if err == nil || err.Error() != "signer panic: crc32 is broken" {
+					t.Errorf("results not match\nGot: %v\nExpected: %v", err, "signer panic: crc32 is broken")
+				}
+				checkLeaks(t, before)
+			}()
+			ExecutePipeline(
+				job(func(in, out chan interface{}) {
+					out <- c.input
+				}),
+				c.job,
+			)
+			t.Errorf("no panic")
+		})
+	}
+}
+
+func TestStageMaxInFlight(t *testing.T) {
+	before := runtime.NumGoroutine()
+	var active, peak, count int32
+	// spawns a goroutine for every item, like SingleHash does
+	spawning := func(ctx context.Context, in, out chan interface{}) error {
+		wg := &sync.WaitGroup{}
+		for v := range in {
+			wg.Add(1)
+			go func(v interface{}) {
+				defer wg.Done()
+				n := atomic.AddInt32(&active, 1)
+				for {
+					p := atomic.LoadInt32(&peak)
+					if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+						break
+					}
+				}
+				time.Sleep(time.Millisecond)
+				atomic.AddInt32(&active, -1)
+				out <- v
+			}(v)
+		}
+		wg.Wait()
+		return nil
+	}
+
+	err := ExecuteStages(context.Background(),
+		StageConfig{Job: func(ctx context.Context, in, out chan interface{}) error {
+			for i := 0; i < 200; i++ {
+				if err := send(ctx, out, i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		StageConfig{Job: spawning, Workers: 2, MaxInFlight: 5, Buffer: -1},
+		StageConfig{Job: func(ctx context.Context, in, out chan interface{}) error {
+			for range in {
+				atomic.AddInt32(&count, 1)
+			}
+			return nil
+		}},
+	)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if count != 200 {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", count, 200)
+	}
+	if peak > 5 {
+		t.Errorf("too many items in flight\nGot: %v\nExpected: <=%v", peak, 5)
+	}
+	checkLeaks(t, before)
+}
+
+// BenchmarkBoundedPipeline streams 1M items through SingleHash and MultiHash
+// with instant signers. peak-heap-MB stays flat however long the stream is.
+func BenchmarkBoundedPipeline(b *testing.B) {
+	md5, crc32 := DataSignerMd5, DataSignerCrc32
+	defer func() {
+		DataSignerMd5, DataSignerCrc32 = md5, crc32
+	}()
+	DataSignerMd5 = func(data string) string {
+		return data
+	}
+	DataSignerCrc32 = func(data string) string {
+		return data
+	}
+	const items = 1000000
+	var peak uint64
+	stopSampling := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		var stats runtime.MemStats
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		defer close(sampled)
+		for {
+			select {
+			case <-stopSampling:
+				return
+			case <-ticker.C:
+			}
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > peak {
+				peak = stats.HeapInuse
+			}
+		}
+	}()
+
+	for n := 0; n < b.N; n++ {
+		err := ExecuteStages(context.Background(),
+			StageConfig{Job: func(ctx context.Context, in, out chan interface{}) error {
+				for i := 0; i < items; i++ {
+					if err := send(ctx, out, i); err != nil {
+						return err
+					}
+				}
+				return nil
+			}},
+			StageConfig{Job: job(SingleHash).withContext(), MaxInFlight: 64},
+			StageConfig{Job: job(MultiHash).withContext(), MaxInFlight: 64},
+			StageConfig{Job: func(ctx context.Context, in, out chan interface{}) error {
+				for range in {
+				}
+				return nil
+			}},
+		)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	close(stopSampling)
+	<-sampled
+	b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+}
+
+func TestStageOrdered(t *testing.T) {
+	before := runtime.NumGoroutine()
+	var started int32
+	var startedBeforeFirst int32
+	var got []int
+
+	err := ExecuteStages(context.Background(),
+		StageConfig{Job: func(ctx context.Context, in, out chan interface{}) error {
+			for i := 0; i < 50; i++ {
+				if err := send(ctx, out, i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		StageConfig{
+			Item: typedItem(func(_ context.Context, i int) int {
+				atomic.AddInt32(&started, 1)
+				if i == 0 {
+					// everything else finishes first and waits in the reorder buffer
+					time.Sleep(50 * time.Millisecond)
+					atomic.StoreInt32(&startedBeforeFirst, atomic.LoadInt32(&started))
+				} else {
+					time.Sleep(time.Duration(i%7) * time.Millisecond)
+				}
+				return i * 10
+			}),
+			Ordered:     true,
+			Workers:     8,
+			MaxInFlight: 10,
+		},
+		StageConfig{Job: func(ctx context.Context, in, out chan interface{}) error {
+			for v := range in {
+				got = append(got, v.(int))
+			}
+			return nil
+		}},
+	)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for i, v := range got {
+		if v != i*10 {
+			t.Fatalf("results not in order\nGot: %v", got)
+		}
+	}
+	if len(got) != 50 {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", len(got), 50)
+	}
+	if startedBeforeFirst > 10 {
+		t.Errorf("reorder buffer not bounded\nGot: %v\nExpected: <=%v", startedBeforeFirst, 10)
+	}
+	checkLeaks(t, before)
+}
+
+func TestOrderedSigner(t *testing.T) {
+	testExpected := "1173136728138862632818075107442090076184424490584241521304_1696913515191343735512658979631549563179965036907783101867_27225454331033649287118297354036464389062965355426795162684_29568666068035183841425683795340791879727309630931025356555_3994492081516972096677631278379039212655368881548151736_4958044192186797981418233587017209679042592862002427381542_4958044192186797981418233587017209679042592862002427381542"
+	inputData := []int{0, 1, 1, 2, 3, 5, 8}
+	var results []string
+
+	start := time.Now()
+	err := ExecuteStages(context.Background(),
+		StageConfig{Job: job(func(in, out chan interface{}) {
+			for _, fibNum := range inputData {
+				out <- fibNum
+			}
+		}).withContext()},
+		StageConfig{Item: typedItemErr(singleHashItem), Ordered: true, Workers: len(inputData)},
+		StageConfig{Item: typedItemErr(multiHashItem), Ordered: true, Workers: len(inputData)},
+		StageConfig{Job: job(func(in, out chan interface{}) {
+			for v := range in {
+				results = append(results, v.(string))
+			}
+		}).withContext()},
+	)
+	end := time.Since(start)
+
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// 1 is the second and the third item, the rest are sorted by CombineResults
+	if len(results) != len(inputData) || results[1] != results[2] {
+		t.Fatalf("results not in order\nGot: %v", results)
+	}
+	sort.Strings(results)
+	if strings.Join(results, "_") != testExpected {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", strings.Join(results, "_"), testExpected)
+	}
+	if end > 3*time.Second {
+		t.Errorf("execition too long\nGot: %s\nExpected: <%s", end, time.Second*3)
+	}
+}
+
+func TestStageItemWrongType(t *testing.T) {
+	before := runtime.NumGoroutine()
+	err := ExecuteStages(context.Background(),
+		StageConfig{Job: endless},
+		StageConfig{Item: typedItem(func(_ context.Context, i int) string {
+			return strconv.Itoa(i)
+		}), Ordered: true, Workers: 4},
+		StageConfig{Item: typedItemErr(singleHashItem)},
+	)
+	var stageErr *StageError
+	if !errors.As(err, &stageErr) || err.Error() != "stage 2: expected int, got string" {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", err, "stage 2: expected int, got string")
+	}
+	checkLeaks(t, before)
+}
+
+func TestObserver(t *testing.T) {
+	md5, crc32 := DataSignerMd5, DataSignerCrc32
+	defer func() {
+		DataSignerMd5, DataSignerCrc32 = md5, crc32
+	}()
+	DataSignerMd5 = func(data string) string {
+		return "md5-" + data
+	}
+	DataSignerCrc32 = func(data string) string {
+		return "crc32-" + data
+	}
+
+	metrics := NewMetrics()
+	logs := &bytes.Buffer{}
+	ctx := WithObserver(context.Background(), MultiObserver(metrics, NewLogObserver(log.New(logs, "", 0))))
+	err := ExecuteStages(ctx,
+		StageConfig{Job: func(ctx context.Context, in, out chan interface{}) error {
+			for i := 0; i < 20; i++ {
+				if err := send(ctx, out, i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}},
+		StageConfig{Item: typedItemErr(singleHashItem), Workers: 4},
+		StageConfig{Job: func(ctx context.Context, in, out chan interface{}) error {
+			for range in {
+			}
+			return nil
+		}},
+	)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(logs.String(), "SingleHash/crc32(md5) result=crc32-md5-7 took") ||
+		!strings.Contains(logs.String(), "SingleHash data=7 result=crc32-7~crc32-md5-7 took") {
+		t.Errorf("spans not logged\nGot:\n%v", logs)
+	}
+
+	exposition := &bytes.Buffer{}
+	if err = metrics.WritePrometheus(exposition); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`pipeline_items_out_total{stage="0"} 20`,
+		`pipeline_items_in_total{stage="1"} 20`,
+		`pipeline_items_out_total{stage="1"} 20`,
+		`pipeline_items_in_total{stage="2"} 20`,
+		`pipeline_item_duration_seconds_bucket{stage="1",le="+Inf"} 20`,
+		`pipeline_item_duration_seconds_count{stage="1"} 20`,
+		`pipeline_span_duration_seconds_count{span="md5"} 20`,
+		`# TYPE pipeline_send_blocked_seconds_total counter`,
+		`# TYPE signer_overheat_wait_seconds_total counter`,
+	} {
+		if !strings.Contains(exposition.String(), line+"\n") {
+			t.Errorf("%v not found in\n%v", line, exposition)
+		}
+	}
+}
+
+func TestSignerCache(t *testing.T) {
+	var calls int32
+	sign := func(data string) string {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return data + DataSignerSalt + "!"
+	}
+	cache := newSignerCache(sign, 2)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if result := cache.Sign("a"); result != "a!" {
+				t.Errorf("results not match\nGot: %v\nExpected: %v", result, "a!")
+			}
+		}()
+	}
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("concurrent calls not merged\nGot: %v\nExpected: %v", calls, 1)
+	}
+
+	cache.Sign("b")
+	cache.Sign("a")
+	cache.Sign("c") // evicts b, a was used later
+	cache.Sign("a")
+	if calls != 3 {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", calls, 3)
+	}
+	cache.Sign("b")
+	if calls != 4 {
+		t.Errorf("evicted result not signed again\nGot: %v\nExpected: %v", calls, 4)
+	}
+
+	defer func(salt string) {
+		DataSignerSalt = salt
+	}(DataSignerSalt)
+	DataSignerSalt = "salt"
+	if result := cache.Sign("a"); result != "asalt!" {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", result, "asalt!")
+	}
+	if calls != 5 {
+		t.Errorf("salt is not a part of the key\nGot: %v\nExpected: %v", calls, 5)
+	}
+}
+
+func TestCachedSigner(t *testing.T) {
+	testExpected := "1173136728138862632818075107442090076184424490584241521304_1696913515191343735512658979631549563179965036907783101867_27225454331033649287118297354036464389062965355426795162684_29568666068035183841425683795340791879727309630931025356555_3994492081516972096677631278379039212655368881548151736_4958044192186797981418233587017209679042592862002427381542_4958044192186797981418233587017209679042592862002427381542"
+	var md5Calls, crc32Calls uint32
+	md5, crc32 := DataSignerMd5, DataSignerCrc32
+	defer func() {
+		DataSignerMd5, DataSignerCrc32 = md5, crc32
+	}()
+	DataSignerMd5 = func(data string) string {
+		atomic.AddUint32(&md5Calls, 1)
+		return md5(data)
+	}
+	DataSignerCrc32 = func(data string) string {
+		atomic.AddUint32(&crc32Calls, 1)
+		return crc32(data)
+	}
+	restore := CacheSigners(100)
+	defer restore()
+
+	inputData := []int{0, 1, 1, 2, 3, 5, 8}
+	testResult := "NOT_SET"
+	ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			for _, fibNum := range inputData {
+				out <- fibNum
+			}
+		}),
+		job(SingleHash),
+		job(MultiHash),
+		job(CombineResults),
+		job(func(in, out chan interface{}) {
+			testResult = (<-in).(string)
+		}),
+	)
+
+	if testResult != testExpected {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", testResult, testExpected)
+	}
+	// 6 distinct numbers, 2 crc32 in SingleHash and 6 in MultiHash for each
+	if md5Calls != 6 || crc32Calls != 6*8 {
+		t.Errorf("repeated input signed again\nGot: %v md5, %v crc32\nExpected: 6 md5, 48 crc32", md5Calls, crc32Calls)
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	sem := NewSemaphore(1)
+	if err := sem.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// a waiter which gives up leaves the queue
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := sem.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", err, context.DeadlineExceeded)
+	}
+
+	var order []int
+	mu := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem.Acquire(context.Background())
+			mu.Lock()
+			order = append(order, i)
+			mu.Unlock()
+			sem.Release()
+		}(i)
+		// let it get into the queue before the next one
+		for sem.waiting() != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	start := time.Now()
+	sem.Release()
+	wg.Wait()
+
+	if fmt.Sprint(order) != "[0 1 2 3 4]" {
+		t.Errorf("waiters not in order\nGot: %v\nExpected: %v", order, "[0 1 2 3 4]")
+	}
+	if took := time.Since(start); took > 100*time.Millisecond {
+		t.Errorf("waiters are too slow\nGot: %v\nExpected: <%v", took, 100*time.Millisecond)
+	}
+	stats := sem.Stats()
+	if stats.Acquired != 6 || stats.Waited != 5 || stats.MaxWait < 20*time.Millisecond {
+		t.Errorf("results not match\nGot: %+v", stats)
+	}
+}
+
+func TestOverheatContext(t *testing.T) {
+	md5 := LegacyScheme().Inner
+	overheat.Acquire(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := md5.call(ctx, "md5", "1")
+	waiting := overheat.waiting()
+	overheat.Release()
+
+	if !errors.Is(err, context.DeadlineExceeded) || waiting != 0 {
+		t.Errorf("results not match\nGot: %v, %d waiting\nExpected: %v, 0 waiting", err, waiting, context.DeadlineExceeded)
+	}
+}
+
+func TestOverheatDirect(t *testing.T) {
+	// callers of DataSignerMd5 which don't go through a Hasher wait in turn
+	results := make([]string, 4)
+	wg := &sync.WaitGroup{}
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = DataSignerMd5("x")
+		}(i)
+	}
+	wg.Wait()
+	expected := fmt.Sprintf("%x", md5.Sum([]byte("x"+DataSignerSalt)))
+	for _, result := range results {
+		if result != expected {
+			t.Errorf("results not match\nGot: %v\nExpected: %v", results, expected)
+			break
+		}
+	}
+}
+
+func TestCachedOverheat(t *testing.T) {
+	md5 := DataSignerMd5
+	defer func() {
+		DataSignerMd5 = md5
+	}()
+	DataSignerMd5 = func(data string) string {
+		return "md5-" + data
+	}
+	restore := CacheSigners(10)
+	defer restore()
+	if _, err := LegacyScheme().Inner.call(context.Background(), "md5", "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a hit doesn't wait behind a call in flight
+	overheat.Acquire(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	result, err := LegacyScheme().Inner.call(ctx, "md5", "1")
+	overheat.Release()
+	if err != nil || result != "md5-1" {
+		t.Errorf("results not match\nGot: %v, %v\nExpected: %v", result, err, "md5-1")
+	}
+}
+
+func TestSignGraph(t *testing.T) {
+	testExpected := "1173136728138862632818075107442090076184424490584241521304_1696913515191343735512658979631549563179965036907783101867_27225454331033649287118297354036464389062965355426795162684_29568666068035183841425683795340791879727309630931025356555_3994492081516972096677631278379039212655368881548151736_4958044192186797981418233587017209679042592862002427381542_4958044192186797981418233587017209679042592862002427381542"
+	testResult := "NOT_SET"
+
+	start := time.Now()
+	err := signGraph(LegacyScheme(), []int{0, 1, 1, 2, 3, 5, 8}, func(result string) {
+		testResult = result
+	}).Run(context.Background())
+	end := time.Since(start)
+
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if testResult != testExpected {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", testResult, testExpected)
+	}
+	if end > 3*time.Second {
+		t.Errorf("execition too long\nGot: %s\nExpected: <%s", end, time.Second*3)
+	}
+
+	// the hashers and the number of th are of the scheme
+	scheme, _ := ParseScheme("sha256,sha512,xxhash", "")
+	scheme.Threads = 3
+	ctx := WithScheme(context.Background(), scheme)
+	var hashes []string
+	for _, num := range []int{2, 1} {
+		single, _ := singleHashItem(ctx, num)
+		multi, _ := multiHashItem(ctx, single)
+		hashes = append(hashes, multi)
+	}
+	sort.Strings(hashes)
+	testExpected = strings.Join(hashes, "_")
+	err = signGraph(scheme, []int{2, 1}, func(result string) {
+		testResult = result
+	}).Run(context.Background())
+	if err != nil || testResult != testExpected {
+		t.Errorf("results not match\nGot: %v %v\nExpected: %v", testResult, err, testExpected)
+	}
+}
+
+// numbers is a graph source of 0..n-1.
+func numbers(n int) ctxJob {
+	return func(ctx context.Context, in, out chan interface{}) error {
+		for i := 0; i < n; i++ {
+			if err := send(ctx, out, i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func TestGraph(t *testing.T) {
+	before := runtime.NumGoroutine()
+	var batches []string
+	g := NewGraph()
+	g.Job("numbers", numbers(10))
+	g.Partition("parity", "numbers", 2, func(v interface{}) int {
+		return v.(int) % 2
+	})
+	g.Window("even", Port("parity", 0), 3, 0)
+	g.Window("odd", Port("parity", 1), 3, 0)
+	g.Merge("all", "even", "odd")
+	g.Job("collect", func(ctx context.Context, in, out chan interface{}) error {
+		for batch := range in {
+			batches = append(batches, fmt.Sprint(batch))
+		}
+		return nil
+	}, "all")
+
+	if err := g.Run(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	sort.Strings(batches)
+	expected := "[[0 2 4] [1 3 5] [6 8] [7 9]]"
+	if fmt.Sprint(batches) != expected {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", batches, expected)
+	}
+	checkLeaks(t, before)
+}
+
+func TestGraphWindowTime(t *testing.T) {
+	var batches []string
+	g := NewGraph()
+	g.Job("slow", func(ctx context.Context, in, out chan interface{}) error {
+		out <- 1
+		out <- 2
+		time.Sleep(50 * time.Millisecond)
+		out <- 3
+		return nil
+	})
+	g.Window("window", "slow", 0, 10*time.Millisecond)
+	g.Job("collect", func(ctx context.Context, in, out chan interface{}) error {
+		for batch := range in {
+			batches = append(batches, fmt.Sprint(batch))
+		}
+		return nil
+	}, "window")
+
+	if err := g.Run(context.Background()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if fmt.Sprint(batches) != "[[1 2] [3]]" {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", batches, "[[1 2] [3]]")
+	}
+}
+
+func TestGraphError(t *testing.T) {
+	before := runtime.NumGoroutine()
+	errBroken := errors.New("broken")
+	g := NewGraph()
+	g.Job("numbers", endless)
+	g.Broadcast("copies", "numbers")
+	g.Job("broken", func(ctx context.Context, in, out chan interface{}) error {
+		for v := range in {
+			if v.(int) == 100 {
+				return errBroken
+			}
+		}
+		return nil
+	}, "copies")
+	g.Job("fine", eachItem(func(ctx context.Context, v interface{}) (interface{}, error) {
+		return v, nil
+	}), "copies")
+
+	err := g.Run(context.Background())
+	var nodeErr *NodeError
+	if !errors.As(err, &nodeErr) || nodeErr.Node != "broken" || !errors.Is(err, errBroken) {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", err, `node "broken": broken`)
+	}
+	checkLeaks(t, before)
+}
+
+func TestGraphValidate(t *testing.T) {
+	pass := job(func(in, out chan interface{}) {
+		for v := range in {
+			out <- v
+		}
+	}).withContext()
+
+	cases := []struct {
+		build    func(g *Graph)
+		expected string
+	}{
+		{func(g *Graph) {
+			g.Job("a", numbers(1))
+			g.Merge("b", "a", "d")
+			g.Job("c", pass, "b")
+			g.Job("d", pass, "c")
+		}, "cycle: [b d c b]"},
+		{func(g *Graph) {
+			g.Job("a", pass, "nowhere")
+		}, `node "a": unknown node "nowhere"`},
+		{func(g *Graph) {
+			g.Job("a", numbers(1))
+			g.Job("b", pass, "a")
+			g.Job("c", pass, "a")
+		}, `node "c": "a" is read by another node, use Broadcast`},
+		{func(g *Graph) {
+			g.Job("a", numbers(1))
+			g.Job("a", numbers(1))
+		}, `node "a" added twice`},
+		{func(g *Graph) {
+			g.Job("a", numbers(1))
+			g.Job("b", numbers(1))
+			g.Job("c", pass, "a", "b")
+		}, `node "c" has more than one input, use Merge`},
+		{func(g *Graph) {
+			g.Job("a", numbers(1))
+			g.Partition("p", "a", 2, func(interface{}) int { return 0 })
+			g.Job("b", pass, Port("p", 2))
+		}, `node "b": unknown node "p[2]"`},
+	}
+	for i, c := range cases {
+		g := NewGraph()
+		c.build(g)
+		if err := g.Run(context.Background()); err == nil || err.Error() != c.expected {
+			t.Errorf("case %d: results not match\nGot: %v\nExpected: %v", i, err, c.expected)
+		}
+	}
+}
+
+// fastSigners swaps the signers for instant ones. broken tells which
+// calls "hang" for a while or "panic".
+func fastSigners(broken func(signer, data string) string) (restore func()) {
+	md5, crc32 := DataSignerMd5, DataSignerCrc32
+	fake := func(signer string) func(string) string {
+		return func(data string) string {
+			switch broken(signer, data) {
+			case "hang":
+				time.Sleep(300 * time.Millisecond)
+			case "panic":
+				panic(signer + " is broken")
+			}
+			return signer + "-" + data
+		}
+	}
+	DataSignerMd5, DataSignerCrc32 = fake("md5"), fake("crc32")
+	return func() {
+		DataSignerMd5, DataSignerCrc32 = md5, crc32
+	}
+}
+
+func TestStageRetry(t *testing.T) {
+	var failures int32
+	defer fastSigners(func(signer, data string) string {
+		// crc32 of 3 fails twice
+		if signer == "crc32" && data == "3" && atomic.AddInt32(&failures, 1) <= 2 {
+			return "panic"
+		}
+		return ""
+	})()
+
+	var got []string
+	err := ExecuteStages(context.Background(),
+		StageConfig{Job: numbers(5)},
+		StageConfig{
+			Item:    typedItemErr(singleHashItem),
+			Ordered: true,
+			Workers: 5,
+			Retry:   RetryPolicy{Attempts: 3, Backoff: time.Millisecond},
+		},
+		StageConfig{Job: func(ctx context.Context, in, out chan interface{}) error {
+			for v := range in {
+				got = append(got, v.(string))
+			}
+			return nil
+		}},
+	)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(got) != 5 || got[3] != "crc32-3~crc32-md5-3" {
+		t.Errorf("results not match\nGot: %v", got)
+	}
+}
+
+func TestStageDeadLetters(t *testing.T) {
+	defer fastSigners(func(signer, data string) string {
+		switch {
+		case signer == "crc32" && data == "2":
+			return "hang"
+		case signer == "md5" && data == "4":
+			return "panic"
+		}
+		return ""
+	})()
+
+	deadLetters := &DeadLetters{}
+	var got []string
+	start := time.Now()
+	err := ExecuteStages(context.Background(),
+		StageConfig{Job: numbers(6)},
+		StageConfig{
+			Item:        typedItemErr(singleHashItem),
+			Ordered:     true,
+			Workers:     2,
+			Retry:       RetryPolicy{Attempts: 2, Timeout: 50 * time.Millisecond, Backoff: time.Millisecond},
+			DeadLetters: deadLetters,
+		},
+		StageConfig{Job: func(ctx context.Context, in, out chan interface{}) error {
+			for v := range in {
+				got = append(got, v.(string))
+			}
+			return nil
+		}},
+	)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("hanging signer not timed out\nGot: %v", took)
+	}
+	expected := "[crc32-0~crc32-md5-0 crc32-1~crc32-md5-1 crc32-3~crc32-md5-3 crc32-5~crc32-md5-5]"
+	if fmt.Sprint(got) != expected {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", got, expected)
+	}
+
+	letters := deadLetters.Letters()
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].Item.(int) < letters[j].Item.(int)
+	})
+	if len(letters) != 2 ||
+		letters[0].Item != 2 || letters[0].Stage != 1 || letters[0].Attempts != 2 || !errors.Is(letters[0].Err, context.DeadlineExceeded) ||
+		letters[1].Item != 4 || letters[1].Err.Error() != "signer panic: md5 is broken" {
+		t.Errorf("results not match\nGot: %+v", letters)
+	}
+}
+
+func TestStageFailureWithoutDeadLetters(t *testing.T) {
+	before := runtime.NumGoroutine()
+	defer fastSigners(func(signer, data string) string {
+		if signer == "crc32" && data == "md5-3" {
+			return "panic"
+		}
+		return ""
+	})()
+
+	err := ExecuteStages(context.Background(),
+		StageConfig{Job: endless},
+		StageConfig{Item: typedItemErr(singleHashItem), Workers: 4, Retry: RetryPolicy{Attempts: 2}},
+	)
+	if err == nil || err.Error() != "stage 1: signer panic: crc32 is broken" {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", err, "stage 1: signer panic: crc32 is broken")
+	}
+	checkLeaks(t, before)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond}
+	for attempt, limit := range []time.Duration{0, 10, 20, 40, 50, 50, 50} {
+		if attempt == 0 {
+			continue
+		}
+		for i := 0; i < 100; i++ {
+			if wait := p.backoff(attempt); wait <= 0 || wait > limit*time.Millisecond {
+				t.Fatalf("attempt %d: wait %v out of (0, %v]", attempt, wait, limit*time.Millisecond)
+			}
+		}
+	}
+	if wait := (RetryPolicy{}).backoff(3); wait != 0 {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", wait, 0)
+	}
+}
+
+func TestRun(t *testing.T) {
+	testExpected := "1173136728138862632818075107442090076184424490584241521304_1696913515191343735512658979631549563179965036907783101867_27225454331033649287118297354036464389062965355426795162684_29568666068035183841425683795340791879727309630931025356555_3994492081516972096677631278379039212655368881548151736_4958044192186797981418233587017209679042592862002427381542_4958044192186797981418233587017209679042592862002427381542\n"
+	opts, files, err := parseArgs([]string{"--workers", "4"}, func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	start := time.Now()
+	err = run(context.Background(), out, strings.NewReader("0\n1\n1\n\n2\n3\n5\n8\n"), files, opts)
+	end := time.Since(start)
+
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if out.String() != testExpected {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", out, testExpected)
+	}
+	// 4 at a time need a second round of SingleHash, 7 at a time take 2s
+	if end < 2500*time.Millisecond || end > 4*time.Second {
+		t.Errorf("workers not limited\nGot: %s\nExpected: 2.5s-4s", end)
+	}
+}
+
+func TestRunStream(t *testing.T) {
+	defer func(salt string) {
+		DataSignerSalt = salt
+	}(DataSignerSalt)
+	var delay int32 = 20
+	defer fastSigners(func(signer, data string) string {
+		// the first numbers are the slowest, the output keeps the order
+		time.Sleep(time.Duration(atomic.AddInt32(&delay, -2)) * time.Millisecond)
+		return ""
+	})()
+
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.txt"), filepath.Join(dir, "second.txt")
+	os.WriteFile(first, []byte("1\n2\n"), 0644)
+	os.WriteFile(second, []byte("\n3\n"), 0644)
+
+	opts, files, err := parseArgs([]string{first, "--stream", second}, func(name string) string {
+		if name == saltEnv {
+			return "~"
+		}
+		return ""
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &bytes.Buffer{}
+	if err = run(context.Background(), out, nil, files, opts); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	var expected strings.Builder
+	for _, line := range []signedLine{{File: first, Line: 1, Value: 1}, {File: first, Line: 2, Value: 2}, {File: second, Line: 2, Value: 3}} {
+		data := strconv.Itoa(line.Value)
+		line.SingleHash = "crc32-" + data + "~crc32-md5-" + data
+		for th := 0; th < 6; th++ {
+			line.MultiHash += "crc32-" + strconv.Itoa(th) + line.SingleHash
+		}
+		encoded, _ := json.Marshal(line)
+		expected.Write(encoded)
+		expected.WriteString("\n")
+	}
+	if out.String() != expected.String() {
+		t.Errorf("results not match\nGot:\n%v\nExpected:\n%v", out, expected.String())
+	}
+	if DataSignerSalt != "~" {
+		t.Errorf("salt not set from the environment\nGot: %q", DataSignerSalt)
+	}
+}
+
+func TestRunBadInput(t *testing.T) {
+	opts, _, _ := parseArgs(nil, func(string) string { return "" })
+	err := run(context.Background(), &bytes.Buffer{}, strings.NewReader("\nx\n"), nil, opts)
+	if err == nil || err.Error() != `stage 0: stdin:2: "x" is not a number` {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", err, `stage 0: stdin:2: "x" is not a number`)
+	}
+
+	err = run(context.Background(), &bytes.Buffer{}, nil, []string{filepath.Join(t.TempDir(), "missing")}, opts)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", err, os.ErrNotExist)
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	env := func(string) string { return "env" }
+	opts, files, err := parseArgs([]string{"a.txt", "--salt", "flag", "b.txt", "--workers=3"}, env)
+	if err != nil || opts.salt != "flag" || opts.workers != 3 || opts.stream || fmt.Sprint(files) != "[a.txt b.txt]" {
+		t.Errorf("results not match\nGot: %+v %v %v", opts, files, err)
+	}
+	if opts, _, _ = parseArgs(nil, env); opts.salt != "env" || opts.workers != stageBuffer {
+		t.Errorf("results not match\nGot: %+v", opts)
+	}
+	if _, _, err = parseArgs([]string{"--workers", "0"}, env); err == nil {
+		t.Errorf("expected an error for 0 workers")
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint")
+	c, err := OpenCheckpoint(path, "salt", "crc32,md5,crc32", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put(stageSingleHash, "a:1", "1", "one")
+	c.Put(stageSingleHash, "a:1", "1", "again")
+	c.Put(stageMultiHash, "a:1", "one", "multi")
+	c.Close()
+
+	// a crash in the middle of a record
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.WriteString(`{"stage":"SingleHash","key":"a:2`)
+	f.Close()
+
+	if c, err = OpenCheckpoint(path, "salt", "crc32,md5,crc32", ""); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok, err := c.Get(stageSingleHash, "a:1", "1"); value != "one" || !ok || err != nil {
+		t.Errorf("results not match\nGot: %v %v %v\nExpected: one true <nil>", value, ok, err)
+	}
+	if _, ok, _ := c.Get(stageSingleHash, "a:2", "2"); ok {
+		t.Errorf("the unfinished record is loaded")
+	}
+	if _, _, err = c.Get(stageMultiHash, "a:1", "two"); err == nil {
+		t.Errorf("expected an error for another input")
+	}
+	c.Put(stageSingleHash, "a:2", "2", "two")
+	c.Close()
+
+	data, _ := os.ReadFile(path)
+	if lines := strings.Count(string(data), "\n"); lines != 4 {
+		t.Errorf("results not match\nGot: %d records\nExpected: 4\n%s", lines, data)
+	}
+	if strings.Contains(string(data), `"salt"`) {
+		t.Errorf("the salt is written as it is\n%s", data)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("results not match\nGot: %v %v\nExpected: -rw-------", info.Mode(), err)
+	}
+	if _, err = OpenCheckpoint(path, "pepper", "crc32,md5,crc32", ""); err == nil {
+		t.Errorf("expected an error for another salt")
+	}
+	if strings.Contains(string(data), fmt.Sprintf("%x", sha256.Sum256([]byte("salt")))) {
+		t.Errorf("the salt is written as its plain sha256\n%s", data)
+	}
+
+	// a log made readable by others is closed again
+	os.Chmod(path, 0644)
+	if c, err = OpenCheckpoint(path, "salt", "crc32,md5,crc32", ""); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("results not match\nGot: %v %v\nExpected: -rw-------", info.Mode(), err)
+	}
+}
+
+func TestRunCheckpoint(t *testing.T) {
+	defer func(salt string) {
+		DataSignerSalt = salt
+	}(DataSignerSalt)
+	var calls, crash int32 = 0, 1
+	defer fastSigners(func(signer, data string) string {
+		atomic.AddInt32(&calls, 1)
+		if signer == "crc32" && data == "0crc32-3~crc32-md5-3" && atomic.LoadInt32(&crash) == 1 {
+			// after the other numbers are done
+			time.Sleep(100 * time.Millisecond)
+			return "panic"
+		}
+		return ""
+	})()
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.txt")
+	os.WriteFile(input, []byte("1\n2\n3\n2\n"), 0644)
+	opts, files, _ := parseArgs([]string{"--checkpoint", filepath.Join(dir, "checkpoint"), input}, func(string) string { return "" })
+
+	if err := run(context.Background(), &bytes.Buffer{}, nil, files, opts); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+	atomic.StoreInt32(&crash, 0)
+
+	var hashes []string
+	for _, num := range []string{"1", "2", "3", "2"} {
+		single := "crc32-" + num + "~crc32-md5-" + num
+		var multi string
+		for th := 0; th < 6; th++ {
+			multi += "crc32-" + strconv.Itoa(th) + single
+		}
+		hashes = append(hashes, multi)
+	}
+	sort.Strings(hashes)
+	expected := strings.Join(hashes, "_") + "\n"
+
+	// only MultiHash of 3 is left
+	for _, expectedCalls := range []int32{6, 0} {
+		atomic.StoreInt32(&calls, 0)
+		out := &bytes.Buffer{}
+		if err := run(context.Background(), out, nil, files, opts); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if out.String() != expected {
+			t.Errorf("results not match\nGot: %v\nExpected: %v", out, expected)
+		}
+		if calls := atomic.LoadInt32(&calls); calls != expectedCalls {
+			t.Errorf("results not match\nGot: %d signer calls\nExpected: %d", calls, expectedCalls)
+		}
+	}
+
+	data, _ := os.ReadFile(opts.checkpoint)
+	if combined := strings.Count(string(data), stageCombineResults); combined != 1 {
+		t.Errorf("results not match\nGot: %d combined results\nExpected: 1", combined)
+	}
+
+	os.WriteFile(input, []byte("1\n2\n3\n2\n5\n"), 0644)
+	if err := run(context.Background(), &bytes.Buffer{}, nil, files, opts); err == nil {
+		t.Errorf("expected an error for the changed input")
+	}
+}
+
+func TestScheme(t *testing.T) {
+	defer func(salt string) {
+		DataSignerSalt = salt
+	}(DataSignerSalt)
+	DataSignerSalt = "salt"
+	scheme, err := ParseScheme("sha256, hmac-sha256,fnv64a", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scheme.String() != "sha256,hmac-sha256,fnv64a" {
+		t.Errorf("results not match\nGot: %v\nExpected: sha256,hmac-sha256,fnv64a", scheme)
+	}
+
+	hexHash := func(h hash.Hash, data string) string {
+		h.Write([]byte(data + "salt"))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+	single := hexHash(sha256.New(), "7") + "~" + hexHash(sha256.New(), hexHash(hmac.New(sha256.New, []byte("key")), "7"))
+	var multi string
+	for th := 0; th < 6; th++ {
+		multi += hexHash(fnv.New64a(), strconv.Itoa(th)+single)
+	}
+
+	ctx := WithScheme(context.Background(), scheme)
+	result, err := singleHashItem(ctx, 7)
+	if err != nil || result != single {
+		t.Errorf("results not match\nGot: %v %v\nExpected: %v", result, err, single)
+	}
+	if result, err = multiHashItem(ctx, single); err != nil || result != multi {
+		t.Errorf("results not match\nGot: %v %v\nExpected: %v", result, err, multi)
+	}
+
+	if scheme, err = ParseScheme("blake2b,xxhash,xxhash", ""); err != nil {
+		t.Fatal(err)
+	}
+	blake, _ := blake2b.New256(nil)
+	single = hexHash(blake, "7") + "~"
+	blake, _ = blake2b.New256(nil)
+	single += hexHash(blake, hexHash(xxhash.New(), "7"))
+	if result, err = singleHashItem(WithScheme(context.Background(), scheme), 7); err != nil || result != single {
+		t.Errorf("results not match\nGot: %v %v\nExpected: %v", result, err, single)
+	}
+
+	for _, names := range []string{"crc32,md5", "crc32,md5,whirlpool", "crc32,hmac-sha256,crc32"} {
+		if _, err = ParseScheme(names, ""); err == nil {
+			t.Errorf("expected an error for %q", names)
+		}
+	}
+}
+
+func TestSchemeEstimate(t *testing.T) {
+	// TestSigner: seven numbers at once in less than 3 seconds
+	estimate := LegacyScheme().Estimate(7, 100)
+	if expected := 2*time.Second + 10*time.Millisecond + 6*10*time.Millisecond; estimate != expected {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", estimate, expected)
+	}
+	if estimate = LegacyScheme().Estimate(7, 4); estimate != 4*time.Second+80*time.Millisecond {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", estimate, 4*time.Second+80*time.Millisecond)
+	}
+	scheme, _ := ParseScheme("sha256,sha512,fnv64a", "")
+	if estimate = scheme.Estimate(1000, 1); estimate != 0 {
+		t.Errorf("results not match\nGot: %v\nExpected: 0", estimate)
+	}
+}
+
+func TestRunScheme(t *testing.T) {
+	defer func(salt string) {
+		DataSignerSalt = salt
+	}(DataSignerSalt)
+	defer fastSigners(func(signer, data string) string {
+		return ""
+	})()
+	opts, files, err := parseArgs([]string{"--scheme", "sha256,md5,fnv64a", "--stream"}, func(string) string { return "" })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err = run(context.Background(), out, strings.NewReader("1\n2\n"), files, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var line signedLine
+	json.NewDecoder(out).Decode(&line)
+	sum := sha256.Sum256([]byte("1"))
+	if !strings.HasPrefix(line.SingleHash, hex.EncodeToString(sum[:])+"~") {
+		t.Errorf("results not match\nGot: %v\nExpected sha256 of 1 first", line.SingleHash)
+	}
+	if _, _, err = parseArgs([]string{"--scheme", "hmac-sha256,md5,crc32"}, func(string) string { return "" }); err == nil {
+		t.Errorf("expected an error for hmac-sha256 without a key")
+	}
+
+	// a checkpoint is resumed only with the key it was made with
+	checkpoint := filepath.Join(t.TempDir(), "checkpoint")
+	for _, c := range []struct {
+		key string
+		ok  bool
+	}{{"one", true}, {"one", true}, {"two", false}} {
+		opts, files, err := parseArgs([]string{"--scheme", "hmac-sha256,md5,crc32", "--hmac-key", c.key, "--checkpoint", checkpoint}, func(string) string { return "" })
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = run(context.Background(), &bytes.Buffer{}, strings.NewReader("1\n2\n"), files, opts)
+		if (err == nil) != c.ok {
+			t.Errorf("results not match\nGot: %v with key %s\nExpected ok: %v", err, c.key, c.ok)
+		}
+	}
+	data, _ := os.ReadFile(checkpoint)
+	if strings.Contains(string(data), "one") {
+		t.Errorf("the key is written as it is\n%s", data)
+	}
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Observer is told what the stages of ExecuteStages do. It is called from
+// many goroutines at once.
+type Observer interface {
+	// Received is called when a stage takes an item, waited is how long the
+	// input was empty.
+	Received(stage int, waited time.Duration)
+	// Sent is called when a stage passed a result on, blocked is how long
+	// the output was full and queued is what is left in it.
+	Sent(stage int, blocked time.Duration, queued int)
+	// Processed is called when an Item stage is done with an item.
+	Processed(stage int, took time.Duration)
+	// StartSpan starts a piece of work, spans started with the returned
+	// context are its children.
+	StartSpan(ctx context.Context, name string) (context.Context, Span)
+}
+
+type Span interface {
+	SetAttr(key, value string)
+	End()
+}
+
+type observerKey struct{}
+
+// WithObserver makes ExecuteStages and the stages it runs report to obs.
+func WithObserver(ctx context.Context, obs Observer) context.Context {
+	return context.WithValue(ctx, observerKey{}, obs)
+}
+
+func observerFrom(ctx context.Context) (Observer, bool) {
+	obs, ok := ctx.Value(observerKey{}).(Observer)
+	return obs, ok
+}
+
+func startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if obs, ok := observerFrom(ctx); ok {
+		return obs.StartSpan(ctx, name)
+	}
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttr(key, value string) {}
+func (nopSpan) End()                      {}
+
+// observe puts proxies around the channels of a stage which report to obs.
+// finish has to be called once the stage is over.
+func observe(obs Observer, stage int, in, out chan interface{}) (chan interface{}, chan interface{}, func()) {
+	observedIn := make(chan interface{})
+	observedOut := make(chan interface{})
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(observedIn)
+		for {
+			start := time.Now()
+			v, ok := <-in
+			if !ok {
+				return
+			}
+			obs.Received(stage, time.Since(start))
+			select {
+			case observedIn <- v:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for v := range observedOut {
+			start := time.Now()
+			out <- v
+			obs.Sent(stage, time.Since(start), len(out))
+		}
+	}()
+
+	finish := func() {
+		close(stop)
+		close(observedOut)
+		wg.Wait()
+	}
+	return observedIn, observedOut, finish
+}
+
+// multiObserver reports to all of its observers.
+type multiObserver []Observer
+
+func MultiObserver(observers ...Observer) Observer {
+	return multiObserver(observers)
+}
+
+func (m multiObserver) Received(stage int, waited time.Duration) {
+	for _, obs := range m {
+		obs.Received(stage, waited)
+	}
+}
+
+func (m multiObserver) Sent(stage int, blocked time.Duration, queued int) {
+	for _, obs := range m {
+		obs.Sent(stage, blocked, queued)
+	}
+}
+
+func (m multiObserver) Processed(stage int, took time.Duration) {
+	for _, obs := range m {
+		obs.Processed(stage, took)
+	}
+}
+
+func (m multiObserver) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	spans := make(multiSpan, 0, len(m))
+	for _, obs := range m {
+		var span Span
+		ctx, span = obs.StartSpan(ctx, name)
+		spans = append(spans, span)
+	}
+	return ctx, spans
+}
+
+type multiSpan []Span
+
+func (m multiSpan) SetAttr(key, value string) {
+	for _, span := range m {
+		span.SetAttr(key, value)
+	}
+}
+
+func (m multiSpan) End() {
+	for _, span := range m {
+		span.End()
+	}
+}
+
+// logObserver logs every finished span, the stage events are left out.
+type logObserver struct {
+	logger *log.Logger
+}
+
+type spanPathKey struct{}
+
+func NewLogObserver(logger *log.Logger) Observer {
+	return &logObserver{logger: logger}
+}
+
+func (l *logObserver) Received(stage int, waited time.Duration)          {}
+func (l *logObserver) Sent(stage int, blocked time.Duration, queued int) {}
+func (l *logObserver) Processed(stage int, took time.Duration)           {}
+
+func (l *logObserver) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	if parent, ok := ctx.Value(spanPathKey{}).(string); ok {
+		name = parent + "/" + name
+	}
+	span := &logSpan{logger: l.logger, name: name, start: time.Now()}
+	return context.WithValue(ctx, spanPathKey{}, name), span
+}
+
+type logSpan struct {
+	logger *log.Logger
+	name   string
+	start  time.Time
+
+	mu    sync.Mutex
+	attrs []string
+}
+
+func (s *logSpan) SetAttr(key, value string) {
+	s.mu.Lock()
+	s.attrs = append(s.attrs, key+"="+value)
+	s.mu.Unlock()
+}
+
+func (s *logSpan) End() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger.Printf("%s %s took %v", s.name, strings.Join(s.attrs, " "), time.Since(s.start))
+}
+
+// latencyBuckets are the upper bounds of the histograms, in seconds.
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(latencyBuckets))
+	}
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+type stageMetrics struct {
+	in, out         uint64
+	queued          int
+	maxQueued       int
+	waited, blocked time.Duration
+	latency         histogram
+}
+
+// Metrics collects the numbers of every stage and the durations of spans.
+type Metrics struct {
+	mu     sync.Mutex
+	stages map[int]*stageMetrics
+	spans  map[string]*histogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		stages: make(map[int]*stageMetrics),
+		spans:  make(map[string]*histogram),
+	}
+}
+
+func (m *Metrics) stage(stage int) *stageMetrics {
+	s, ok := m.stages[stage]
+	if !ok {
+		s = &stageMetrics{}
+		m.stages[stage] = s
+	}
+	return s
+}
+
+func (m *Metrics) Received(stage int, waited time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.stage(stage)
+	s.in++
+	s.waited += waited
+}
+
+func (m *Metrics) Sent(stage int, blocked time.Duration, queued int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.stage(stage)
+	s.out++
+	s.blocked += blocked
+	s.queued = queued
+	if queued > s.maxQueued {
+		s.maxQueued = queued
+	}
+}
+
+func (m *Metrics) Processed(stage int, took time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stage(stage).latency.observe(took)
+}
+
+func (m *Metrics) StartSpan(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, &metricsSpan{metrics: m, name: name, start: time.Now()}
+}
+
+type metricsSpan struct {
+	metrics *Metrics
+	name    string
+	start   time.Time
+}
+
+func (s *metricsSpan) SetAttr(key, value string) {}
+
+func (s *metricsSpan) End() {
+	took := time.Since(s.start)
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+	h, ok := s.metrics.spans[s.name]
+	if !ok {
+		h = &histogram{}
+		s.metrics.spans[s.name] = h
+	}
+	h.observe(took)
+}
+
+// WritePrometheus writes the metrics in the Prometheus text format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stages := make([]int, 0, len(m.stages))
+	for stage := range m.stages {
+		stages = append(stages, stage)
+	}
+	sort.Ints(stages)
+	spans := make([]string, 0, len(m.spans))
+	for name := range m.spans {
+		spans = append(spans, name)
+	}
+	sort.Strings(spans)
+
+	b := &strings.Builder{}
+	metric := func(name, kind string, value func(s *stageMetrics) interface{}) {
+		fmt.Fprintf(b, "# TYPE %s %s\n", name, kind)
+		for _, stage := range stages {
+			fmt.Fprintf(b, "%s{stage=\"%d\"} %v\n", name, stage, value(m.stages[stage]))
+		}
+	}
+	metric("pipeline_items_in_total", "counter", func(s *stageMetrics) interface{} { return s.in })
+	metric("pipeline_items_out_total", "counter", func(s *stageMetrics) interface{} { return s.out })
+	metric("pipeline_queue_depth", "gauge", func(s *stageMetrics) interface{} { return s.queued })
+	metric("pipeline_queue_depth_max", "gauge", func(s *stageMetrics) interface{} { return s.maxQueued })
+	metric("pipeline_receive_wait_seconds_total", "counter", func(s *stageMetrics) interface{} { return s.waited.Seconds() })
+	metric("pipeline_send_blocked_seconds_total", "counter", func(s *stageMetrics) interface{} { return s.blocked.Seconds() })
+
+	fmt.Fprintf(b, "# TYPE pipeline_item_duration_seconds histogram\n")
+	for _, stage := range stages {
+		if h := &m.stages[stage].latency; h.count > 0 {
+			writeHistogram(b, "pipeline_item_duration_seconds", fmt.Sprintf("stage=\"%d\"", stage), h)
+		}
+	}
+	fmt.Fprintf(b, "# TYPE pipeline_span_duration_seconds histogram\n")
+	for _, name := range spans {
+		writeHistogram(b, "pipeline_span_duration_seconds", fmt.Sprintf("span=%q", name), m.spans[name])
+	}
+
+	// the limiter of DataSignerMd5 is shared by every pipeline of the process
+	overheatStats := overheat.Stats()
+	fmt.Fprintf(b, "# TYPE signer_overheat_acquired_total counter\nsigner_overheat_acquired_total %d\n", overheatStats.Acquired)
+	fmt.Fprintf(b, "# TYPE signer_overheat_waited_total counter\nsigner_overheat_waited_total %d\n", overheatStats.Waited)
+	fmt.Fprintf(b, "# TYPE signer_overheat_wait_seconds_total counter\nsigner_overheat_wait_seconds_total %v\n", overheatStats.WaitTime.Seconds())
+	fmt.Fprintf(b, "# TYPE signer_overheat_wait_seconds_max gauge\nsigner_overheat_wait_seconds_max %v\n", overheatStats.MaxWait.Seconds())
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeHistogram(b *strings.Builder, name, labels string, h *histogram) {
+	for i, bound := range latencyBuckets {
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"%v\"} %d\n", name, labels, bound, h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(b, "%s_sum{%s} %v\n", name, labels, h.sum)
+	fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, h.count)
+}
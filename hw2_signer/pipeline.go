@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+)
+
+const stageBuffer = 100
+
+// Stage reads values from in and sends results to out. The stage must not
+// close out, whoever runs the stage closes it after the stage returns.
+type Stage[In, Out any] func(in <-chan In, out chan<- Out)
+
+// Pipe connects the output of first to the input of second.
+func Pipe[A, B, C any](first Stage[A, B], second Stage[B, C]) Stage[A, C] {
+	return func(in <-chan A, out chan<- C) {
+		mid := make(chan B, stageBuffer)
+		done := make(chan struct{})
+		go func() {
+			first(in, mid)
+			close(mid)
+			close(done)
+		}()
+		second(mid, out)
+		<-done
+	}
+}
+
+// Source is the first stage, it sends the values and ignores its input.
+func Source[T any](values ...T) Stage[struct{}, T] {
+	return func(_ <-chan struct{}, out chan<- T) {
+		for _, v := range values {
+			out <- v
+		}
+	}
+}
+
+// Run executes the stage and passes every result to sink.
+func Run[Out any](stage Stage[struct{}, Out], sink func(Out)) {
+	in := make(chan struct{})
+	close(in)
+	out := make(chan Out, stageBuffer)
+	go func() {
+		stage(in, out)
+		close(out)
+	}()
+	for v := range out {
+		sink(v)
+	}
+}
+
+// FromJob lets an untyped job run as a typed stage. The job has to send
+// values of type Out, another one panics in the goroutine of the stage once
+// the job is over.
+func FromJob[In, Out any](j job) Stage[In, Out] {
+	return func(in <-chan In, out chan<- Out) {
+		rawIn := make(chan interface{}, stageBuffer)
+		stop := make(chan struct{})
+		go func() {
+			defer close(rawIn)
+			for v := range in {
+				select {
+				case rawIn <- v:
+				case <-stop:
+					// the job is over, the rest is dropped
+					return
+				}
+			}
+		}()
+
+		rawOut := make(chan interface{}, stageBuffer)
+		done := make(chan struct{})
+		var failure interface{}
+		go func() {
+			for v := range rawOut {
+				// after a failure the job is only drained, so it doesn't get stuck
+				if failure == nil {
+					failure = recovered(func() { out <- assertType[Out](v) })
+				}
+			}
+			close(done)
+		}()
+
+		func() {
+			// a panicking job stops the forwarders too
+			defer func() {
+				close(rawOut)
+				close(stop)
+				<-done
+			}()
+			j(rawIn, rawOut)
+		}()
+		if failure != nil {
+			panic(failure)
+		}
+	}
+}
+
+// job lets a typed stage run in ExecutePipeline. The previous job has to
+// send values of type In, another one ends the input of the stage and
+// panics in the goroutine of the job once the stage is over.
+func (s Stage[In, Out]) job() job {
+	return func(in, out chan interface{}) {
+		typedIn := make(chan In, stageBuffer)
+		stop := make(chan struct{})
+		failed := make(chan interface{}, 1)
+		if in == nil {
+			// the first job of ExecutePipeline gets no input
+			close(typedIn)
+		} else {
+			go func() {
+				defer close(typedIn)
+				for v := range in {
+					var typed In
+					if r := recovered(func() { typed = assertType[In](v) }); r != nil {
+						failed <- r
+						return
+					}
+					select {
+					case typedIn <- typed:
+					case <-stop:
+						// the stage is over, the rest of in is left to the caller
+						return
+					}
+				}
+			}()
+		}
+
+		typedOut := make(chan Out, stageBuffer)
+		done := make(chan struct{})
+		go func() {
+			for v := range typedOut {
+				out <- v
+			}
+			close(done)
+		}()
+
+		func() {
+			// a panicking stage stops the forwarders too
+			defer func() {
+				close(typedOut)
+				close(stop)
+				<-done
+			}()
+			s(typedIn, typedOut)
+		}()
+		select {
+		case r := <-failed:
+			panic(r)
+		default:
+		}
+	}
+}
+
+// recovered calls f and returns its panic. A forwarding goroutine can't let
+// a panic go on, nobody could recover it there.
+func recovered(f func()) (r interface{}) {
+	defer func() {
+		r = recover()
+	}()
+	f()
+	return nil
+}
+
+func assertType[T any](v interface{}) T {
+	typed, ok := v.(T)
+	if !ok {
+		panic(fmt.Sprintf("pipeline: expected %v, got %T", reflect.TypeOf((*T)(nil)).Elem(), v))
+	}
+	return typed
+}
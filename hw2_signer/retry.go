@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy is how an Item stage deals with a failed item.
+type RetryPolicy struct {
+	// Attempts is the number of calls of Item before the item fails, 1 if
+	// not set.
+	Attempts int
+	// Timeout limits every attempt through its context.
+	Timeout time.Duration
+	// Backoff is the wait before the second attempt, it doubles with every
+	// next one up to MaxBackoff. The actual wait is a random part of it,
+	// so the retries of many items don't come at once.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// DeadLetter is an item which failed all its attempts.
+type DeadLetter struct {
+	Stage    int
+	Item     interface{}
+	Attempts int
+	Err      error
+}
+
+// DeadLetters collects the failed items of the stages which have it, the
+// pipeline goes on without them.
+type DeadLetters struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+}
+
+func (d *DeadLetters) add(letter DeadLetter) {
+	d.mu.Lock()
+	d.letters = append(d.letters, letter)
+	d.mu.Unlock()
+}
+
+func (d *DeadLetters) Letters() []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]DeadLetter(nil), d.letters...)
+}
+
+// call runs f until it succeeds, runs out of attempts or ctx is done.
+func (p RetryPolicy) call(ctx context.Context, f itemFunc, v interface{}) (interface{}, int, error) {
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	for attempt := 1; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if p.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, p.Timeout)
+		}
+		result, err := runItem(attemptCtx, f, v)
+		cancel()
+		if err == nil || attempt >= attempts || ctx.Err() != nil {
+			return result, attempt, err
+		}
+
+		timer := time.NewTimer(p.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, attempt, ctx.Err()
+		}
+	}
+}
+
+// backoff is the wait after the attempt, with full jitter.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	wait := p.Backoff
+	for i := 1; i < attempt && wait > 0 && (p.MaxBackoff <= 0 || wait < p.MaxBackoff); i++ {
+		wait *= 2
+	}
+	if p.MaxBackoff > 0 && (wait > p.MaxBackoff || wait < 0) {
+		wait = p.MaxBackoff
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(wait))) + 1
+}
+
+// callSigner runs the signer until ctx is done, its panic is returned as
+// an error. A signer can't be stopped, after ctx is done it goes on in the
+// background and its result is lost.
+func callSigner(ctx context.Context, sign func(string) string, data string) (string, error) {
+	type result struct {
+		hash string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{err: fmt.Errorf("signer panic: %v", r)}
+			}
+		}()
+		done <- result{hash: sign(data)}
+	}()
+
+	select {
+	case r := <-done:
+		return r.hash, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
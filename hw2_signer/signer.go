@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"strconv"
@@ -8,105 +10,350 @@ import (
 	"sort"
 )
 
+// ctxJob is a job which can fail. It has to return once ctx is done,
+// sending to out may block otherwise.
+type ctxJob func(ctx context.Context, in, out chan interface{}) error
+
+// StageError is the first failure of a pipeline, Stage is the index of the
+// failed job.
+type StageError struct {
+	Stage int
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("stage %d: %v", e.Stage, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError is a panic of a job, Value is what it panicked with.
+type PanicError struct {
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// ExecutePipeline runs jobs which know nothing about errors. A job which
+// panics stops the others and its panic goes on in the caller.
 func ExecutePipeline(jobs ...job) {
-	wg := &sync.WaitGroup{}
-	var in chan interface{}
-	for _, val := range jobs {
-		out := make(chan interface{}, 100)
-		wg.Add(1)
-		go func(f job, out chan interface{}, in chan interface{}) {
-			f(in, out)
-			close(out)
-			wg.Done()
-		}(val, out, in)
-		in = out
+	ctxJobs := make([]ctxJob, 0, len(jobs))
+	for _, j := range jobs {
+		ctxJobs = append(ctxJobs, j.withContext())
+	}
+	err := ExecutePipelineContext(context.Background(), ctxJobs...)
+	var p *PanicError
+	if errors.As(err, &p) {
+		panic(p.Value)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+// ExecutePipelineContext runs the jobs until all of them return. The first
+// error cancels ctx of the others and is returned as a *StageError. Every
+// job's input is drained after it returns, so the jobs before it never get
+// stuck on a send.
+func ExecutePipelineContext(ctx context.Context, jobs ...ctxJob) error {
+	stages := make([]StageConfig, 0, len(jobs))
+	for _, j := range jobs {
+		stages = append(stages, StageConfig{Job: j})
+	}
+	return ExecuteStages(ctx, stages...)
+}
+
+func runJob(ctx context.Context, f ctxJob, in, out chan interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r}
+		}
+	}()
+	return f(ctx, in, out)
+}
+
+// withContext runs a job which knows nothing about ctx, it never fails and
+// stops only when its input is over.
+func (j job) withContext() ctxJob {
+	return func(_ context.Context, in, out chan interface{}) error {
+		j(in, out)
+		return nil
+	}
+}
+
+// send sends v unless ctx is done first.
+func send(ctx context.Context, out chan interface{}, v interface{}) error {
+	select {
+	case out <- v:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	wg.Wait()
 }
 
 func SingleHash(in, out chan interface{}) {
-	mu := &sync.Mutex{}
+	Stage[int, string](singleHash).job()(in, out)
+}
+
+func MultiHash(in, out chan interface{}) {
+	Stage[string, string](multiHash).job()(in, out)
+}
+
+func CombineResults(in, out chan interface{}) {
+	Stage[string, string](combineResults).job()(in, out)
+}
+
+// itemErr keeps the first error of the items of a job. The job panics with
+// it once all the items are over: a panic in the goroutine of an item
+// couldn't be recovered by the caller of the job.
+type itemErr struct {
+	once sync.Once
+	err  error
+}
+
+func (e *itemErr) set(err error) {
+	e.once.Do(func() {
+		e.err = err
+	})
+}
+
+func (e *itemErr) raise() {
+	if e.err != nil {
+		// a job can't fail, a broken signer brings the pipeline down
+		panic(e.err)
+	}
+}
+
+func singleHash(in <-chan int, out chan<- string) {
+	// an item takes a place before its goroutine is started, so a long
+	// input doesn't start all of them at once
+	limit := NewSemaphore(MaxInputDataLen)
+	failure := &itemErr{}
 	wgoutr := &sync.WaitGroup{}
 	for num := range in {
-		data := strconv.Itoa(num.(int))
-
+		limit.Acquire(context.Background())
 		wgoutr.Add(1)
-		go func(data string) {
-			wg := &sync.WaitGroup{}
-			var md5result string
-			var crc32md5result string
-			var crc32result string
-			fmt.Printf("%s SingleHash data %[1]s\n", data)
-
-			wg.Add(1)
-			go func() {
-				mu.Lock()
-				md5result = DataSignerMd5(data)
-				fmt.Printf("%s SingleHash md5(data) %s\n", data, md5result)
-				mu.Unlock()
-				crc32md5result = DataSignerCrc32(md5result)
-				fmt.Printf("%s SingleHash crc32(md5(data)) %s\n", data, crc32md5result)
-				wg.Done()
-			}()
-
-			wg.Add(1)
-			go func() {
-				crc32result = DataSignerCrc32(data)
-				fmt.Printf("%s SingleHash crc32(data) %s\n", data, crc32result)
-				wg.Done()
-			}()
-
-			wg.Wait()
-			result := crc32result + "~" + crc32md5result
-			fmt.Printf("%s SingleHash result %s\n", data, result)
-
+		go func(num int) {
+			defer wgoutr.Done()
+			defer limit.Release()
+			result, err := singleHashItem(context.Background(), num)
+			if err != nil {
+				failure.set(err)
+				return
+			}
 			out <- result
-			wgoutr.Done()
-		}(data)
+		}(num)
 	}
 
 	wgoutr.Wait()
+	failure.raise()
 }
 
-func MultiHash(in, out chan interface{}) {
-	wgoutr := &sync.WaitGroup{}
-	for indata := range in {
+// singleHashItem is crc32(data)+"~"+crc32(md5(data)), both crc32 run at once.
+// The hashers are of the scheme in ctx.
+func singleHashItem(ctx context.Context, num int) (string, error) {
+	data := strconv.Itoa(num)
+	scheme := schemeFrom(ctx)
+	ctx, span := startSpan(ctx, "SingleHash")
+	defer span.End()
+	span.SetAttr("data", data)
+
+	wg := &sync.WaitGroup{}
+	var outerInnerResult, outerResult string
+	var outerInnerErr, outerErr error
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		innerResult, err := scheme.Inner.call(ctx, scheme.Inner.Name, data)
+		if err != nil {
+			outerInnerErr = err
+			return
+		}
+		outerInnerResult, outerInnerErr = scheme.Outer.call(ctx, scheme.Outer.Name+"("+scheme.Inner.Name+")", innerResult)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		outerResult, outerErr = scheme.Outer.call(ctx, scheme.Outer.Name, data)
+	}()
+
+	wg.Wait()
+	for _, err := range []error{outerErr, outerInnerErr} {
+		if err != nil {
+			span.SetAttr("error", err.Error())
+			return "", err
+		}
+	}
+	result := outerResult + "~" + outerInnerResult
+	span.SetAttr("result", result)
+	return result, nil
+}
 
+func multiHash(in <-chan string, out chan<- string) {
+	limit := NewSemaphore(MaxInputDataLen)
+	failure := &itemErr{}
+	wgoutr := &sync.WaitGroup{}
+	for data := range in {
+		limit.Acquire(context.Background())
 		wgoutr.Add(1)
-		go func() {
-			wg := &sync.WaitGroup{}
-			data := indata.(string)
-			fmt.Printf("MultiHash data %s\n", data)
-			var arr [6]string
-			for i := 0; i < 6; i++ {
-				par := strconv.Itoa(i) + data
-				wg.Add(1)
-				go func(par string, ind int) {
-					iresult := DataSignerCrc32(par)
-					fmt.Printf("%s MultiHash: crc32(th+step1)) %d %s\n", data, ind, iresult)
-					arr[ind] = iresult
-					wg.Done()
-				}(par, i)
+		go func(data string) {
+			defer wgoutr.Done()
+			defer limit.Release()
+			result, err := multiHashItem(context.Background(), data)
+			if err != nil {
+				failure.set(err)
+				return
 			}
-			wg.Wait()
-			result := strings.Join(arr[:], "")
 			out <- result
-			wgoutr.Done()
-		}()
+		}(data)
 	}
 	wgoutr.Wait()
+	failure.raise()
 }
 
-func CombineResults(in, out chan interface{}) {
+// multiHashItem joins crc32(th+data) for th 0..5, all of them run at once.
+// The hasher and the number of th are of the scheme in ctx.
+func multiHashItem(ctx context.Context, data string) (string, error) {
+	scheme := schemeFrom(ctx)
+	ctx, span := startSpan(ctx, "MultiHash")
+	defer span.End()
+	span.SetAttr("data", data)
+
+	wg := &sync.WaitGroup{}
+	arr := make([]string, scheme.Threads)
+	errs := make([]error, scheme.Threads)
+	for i := 0; i < scheme.Threads; i++ {
+		par := strconv.Itoa(i) + data
+		wg.Add(1)
+		go func(par string, ind int) {
+			defer wg.Done()
+			arr[ind], errs[ind] = scheme.Multi.call(ctx, scheme.Multi.Name+"(th+data)", par)
+		}(par, i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			span.SetAttr("error", err.Error())
+			return "", err
+		}
+	}
+	result := strings.Join(arr, "")
+	span.SetAttr("result", result)
+	return result, nil
+}
+
+// sign calls the signer within a span.
+func sign(ctx context.Context, name string, signer func(string) string, data string) (string, error) {
+	_, span := startSpan(ctx, name)
+	defer span.End()
+	result, err := callSigner(ctx, signer, data)
+	if err != nil {
+		span.SetAttr("error", err.Error())
+		return "", err
+	}
+	span.SetAttr("result", result)
+	return result, nil
+}
+
+func combineResults(in <-chan string, out chan<- string) {
 	var sl []string
 	for data := range in {
-		sl = append(sl, data.(string))
+		sl = append(sl, data)
 	}
 	sort.Slice(sl, func(i, j int) bool {
 		return sl[i] < sl[j]
 	})
-	result := strings.Join(sl, "_")
-	fmt.Printf("CombineFinishResults  %v\n", result)
+	out <- strings.Join(sl, "_")
+}
+
+type seqItem struct {
+	seq int
+	v   interface{}
+}
+
+type hashPart struct {
+	seq  int
+	th   int
+	hash string
+}
+
+// signGraph is the signer of scheme built of graph nodes: MultiHash is a
+// node of the Multi hasher for every th behind a Broadcast, and
+// CombineResults is a Window of all the results which gets sorted.
+func signGraph(scheme Scheme, inputData []int, result func(string)) *Graph {
+	g := NewGraph()
+	g.Job("input", func(ctx context.Context, in, out chan interface{}) error {
+		for i, num := range inputData {
+			if err := send(ctx, out, seqItem{i, num}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	g.Job("SingleHash", eachItem(func(ctx context.Context, v interface{}) (interface{}, error) {
+		item := v.(seqItem)
+		hash, err := singleHashItem(WithScheme(ctx, scheme), item.v.(int))
+		return seqItem{item.seq, hash}, err
+	}), "input")
 
-	out <- result
-}
\ No newline at end of file
+	g.Broadcast("th", "SingleHash")
+	var parts []string
+	for th := 0; th < scheme.Threads; th++ {
+		th := th
+		name := fmt.Sprintf("%s(%d+data)", scheme.Multi.Name, th)
+		g.Job(name, eachItem(func(ctx context.Context, v interface{}) (interface{}, error) {
+			item := v.(seqItem)
+			hash, err := scheme.Multi.call(ctx, scheme.Multi.Name+"(th+data)", strconv.Itoa(th)+item.v.(string))
+			return hashPart{item.seq, th, hash}, err
+		}), "th")
+		parts = append(parts, name)
+	}
+	g.Merge("parts", parts...)
+	g.Job("MultiHash", func(ctx context.Context, in, out chan interface{}) error {
+		hashes := make(map[int][]string)
+		done := make(map[int]int)
+		for v := range in {
+			part := v.(hashPart)
+			if hashes[part.seq] == nil {
+				hashes[part.seq] = make([]string, scheme.Threads)
+			}
+			hashes[part.seq][part.th] = part.hash
+			if done[part.seq]++; done[part.seq] == scheme.Threads {
+				if err := send(ctx, out, strings.Join(hashes[part.seq], "")); err != nil {
+					return err
+				}
+				delete(hashes, part.seq)
+				delete(done, part.seq)
+			}
+		}
+		return nil
+	}, "parts")
+
+	g.Window("all", "MultiHash", 0, 0)
+	g.Job("CombineResults", func(ctx context.Context, in, out chan interface{}) error {
+		for batch := range in {
+			var sl []string
+			for _, v := range batch.([]interface{}) {
+				sl = append(sl, v.(string))
+			}
+			sort.Strings(sl)
+			if err := send(ctx, out, strings.Join(sl, "_")); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, "all")
+	g.Job("result", func(ctx context.Context, in, out chan interface{}) error {
+		for v := range in {
+			result(v.(string))
+		}
+		return nil
+	}, "CombineResults")
+	return g
+}
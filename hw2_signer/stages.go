@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// itemFunc turns one input item into one result.
+type itemFunc func(ctx context.Context, v interface{}) (interface{}, error)
+
+var errJobAndItem = errors.New("stage has both Job and Item")
+
+// StageConfig is a job along with how it is run. Zero values mean the
+// defaults of ExecutePipeline.
+type StageConfig struct {
+	Job ctxJob
+	// Item replaces Job for stages which map every item to one result, it is
+	// called by Workers goroutines at once.
+	Item itemFunc
+	// Ordered makes an Item stage send the results in the order of the
+	// input. Only MaxInFlight items can be ahead of the oldest unfinished
+	// one, that is how many results the reorder buffer holds at most.
+	Ordered bool
+	// Workers is the number of copies of Job reading the same input.
+	Workers int
+	// Buffer is the capacity of the output channel, stageBuffer if not set
+	// and unbuffered if negative.
+	Buffer int
+	// MaxInFlight limits the items taken from the input and not sent on
+	// yet. Once it is reached the input isn't read any more and the stages
+	// before block on it. Every item has to produce exactly one result, so
+	// it must not be set for jobs which drop or combine items. Item stages
+	// take stageBuffer items if not set.
+	MaxInFlight int
+	// Retry is applied to the failed items of an Item stage.
+	Retry RetryPolicy
+	// DeadLetters gets the items of an Item stage which failed all their
+	// attempts, the stage goes on without them. A failed item stops the
+	// pipeline if it is not set.
+	DeadLetters *DeadLetters
+}
+
+// ExecuteStages is ExecutePipelineContext with the options of every stage.
+func ExecuteStages(ctx context.Context, stages ...StageConfig) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	wg := &sync.WaitGroup{}
+	in := make(chan interface{})
+	close(in)
+	for i, stage := range stages {
+		buffer := stage.Buffer
+		if buffer == 0 {
+			buffer = stageBuffer
+		} else if buffer < 0 {
+			buffer = 0
+		}
+		out := make(chan interface{}, buffer)
+		wg.Add(1)
+		go func(i int, stage StageConfig, in, out chan interface{}) {
+			defer wg.Done()
+			if err := runStage(ctx, i, stage, in, out); err != nil {
+				fail(&StageError{Stage: i, Err: err})
+			}
+			close(out)
+			for range in {
+			}
+		}(i, stage, in, out)
+		in = out
+	}
+	for range in {
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// runStage runs the workers of the stage, behind a gate if the items in
+// flight are limited. It returns the first error of the workers.
+func runStage(ctx context.Context, index int, stage StageConfig, in, out chan interface{}) error {
+	if obs, ok := observerFrom(ctx); ok {
+		var finish func()
+		in, out, finish = observe(obs, index, in, out)
+		defer finish()
+	}
+	if stage.Item != nil {
+		if stage.Job != nil {
+			return errJobAndItem
+		}
+		return runItems(ctx, index, stage, in, out)
+	}
+	if stage.MaxInFlight > 0 {
+		var finish func()
+		in, out, finish = gate(ctx, stage.MaxInFlight, in, out)
+		defer finish()
+	}
+
+	workers := stage.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers == 1 {
+		return runJob(ctx, stage.Job, in, out)
+	}
+
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			errs <- runJob(ctx, stage.Job, in, out)
+		}()
+	}
+	var firstErr error
+	for i := 0; i < workers; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// gate passes an item from in only when fewer than limit items are between
+// the returned channels. finish has to be called once the job is over.
+func gate(ctx context.Context, limit int, in, out chan interface{}) (chan interface{}, chan interface{}, func()) {
+	tokens := make(chan struct{}, limit)
+	gatedIn := make(chan interface{})
+	gatedOut := make(chan interface{})
+	stop := make(chan struct{})
+	wg := &sync.WaitGroup{}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer close(gatedIn)
+		for v := range in {
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			case <-stop:
+				return
+			}
+			select {
+			case gatedIn <- v:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		for v := range gatedOut {
+			out <- v
+			select {
+			case <-tokens:
+			default:
+			}
+		}
+	}()
+
+	finish := func() {
+		close(stop)
+		close(gatedOut)
+		wg.Wait()
+	}
+	return gatedIn, gatedOut, finish
+}
+
+type sequenced struct {
+	seq int
+	v   interface{}
+	// dropped is the place of a dead letter, there is no result
+	dropped bool
+}
+
+// runItems calls Item for every item with a pool of workers. Up to
+// MaxInFlight items are taken before the oldest one is sent on, so the
+// reorder buffer of an Ordered stage never grows beyond it.
+func runItems(ctx context.Context, index int, stage StageConfig, in, out chan interface{}) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	obs, observed := observerFrom(ctx)
+
+	workers := stage.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	window := stage.MaxInFlight
+	if window < 1 {
+		window = stageBuffer
+	}
+
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	tokens := make(chan struct{}, window)
+	items := make(chan sequenced)
+	results := make(chan sequenced)
+	wg := &sync.WaitGroup{}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(items)
+		seq := 0
+		for v := range in {
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case items <- sequenced{seq: seq, v: v}:
+			case <-ctx.Done():
+				return
+			}
+			seq++
+		}
+	}()
+
+	workersWg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		workersWg.Add(1)
+		go func() {
+			defer workersWg.Done()
+			for item := range items {
+				if ctx.Err() != nil {
+					continue
+				}
+				start := time.Now()
+				v, attempts, err := stage.Retry.call(ctx, stage.Item, item.v)
+				if observed {
+					obs.Processed(index, time.Since(start))
+				}
+				switch {
+				case err == nil:
+					results <- sequenced{seq: item.seq, v: v}
+				case stage.DeadLetters != nil && ctx.Err() == nil:
+					stage.DeadLetters.add(DeadLetter{Stage: index, Item: item.v, Attempts: attempts, Err: err})
+					results <- sequenced{seq: item.seq, dropped: true}
+				default:
+					fail(err)
+				}
+			}
+		}()
+	}
+	go func() {
+		workersWg.Wait()
+		close(results)
+	}()
+
+	pending := make(map[int]sequenced)
+	next := 0
+	for r := range results {
+		if ctx.Err() != nil {
+			continue
+		}
+		if !stage.Ordered {
+			if !r.dropped {
+				out <- r.v
+			}
+			<-tokens
+			continue
+		}
+		pending[r.seq] = r
+		for {
+			r, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			if !r.dropped {
+				out <- r.v
+			}
+			<-tokens
+			next++
+		}
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func runItem(ctx context.Context, f itemFunc, v interface{}) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return f(ctx, v)
+}
+
+// typedItem makes an itemFunc of a typed function, an item of another type
+// fails the stage.
+func typedItem[In, Out any](f func(context.Context, In) Out) itemFunc {
+	return typedItemErr(func(ctx context.Context, v In) (Out, error) {
+		return f(ctx, v), nil
+	})
+}
+
+// typedItemErr is typedItem for functions which can fail.
+func typedItemErr[In, Out any](f func(context.Context, In) (Out, error)) itemFunc {
+	return func(ctx context.Context, v interface{}) (interface{}, error) {
+		typed, ok := v.(In)
+		if !ok {
+			return nil, fmt.Errorf("expected %v, got %T", reflect.TypeOf((*In)(nil)).Elem(), v)
+		}
+		return f(ctx, typed)
+	}
+}
@@ -4,8 +4,7 @@ import (
 	"io"
 	"fmt"
 	"os"
-	"strings"
-	"bufio"
+	"runtime"
 	"encoding/json"
 	"github.com/mailru/easyjson/jlexer"
 	"github.com/mailru/easyjson/jwriter"
@@ -155,78 +154,30 @@ func (v *User) UnmarshalEasyJSON(l *jlexer.Lexer) {
 	easyjson95a2be9cDecode(l, v)
 }
 
+// androidMSIE is the query of SlowSearch: users of both Android and MSIE,
+// and the number of the distinct browsers of the two of all users.
+var androidMSIE = MustCompile(
+	`browsers contains "Android" and browsers contains "MSIE"`,
+	"[{#}] {name} <{email|at}>",
+)
+
 // вам надо написать более быструю оптимальную этой функции
 func FastSearch(out io.Writer) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		panic(err)
 	}
-
-	seenBrowsers := make([]string, 0, 150)
-	uniqueBrowsers := 0
-	i := -1
-	isAndroid := false
-	isMSIE := false
-	notSeenBefore := true
-
-	//var user *User
-	//var dataPool = sync.Pool{
-	//	New: func() interface{} {
-	//		return &User{}
-	//	},
-	//}
-
-	user := &User{}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		panic(err)
+	}
 
 	fmt.Fprintln(out, "found users:")
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		//user = dataPool.Get().(*User)
-		user.UnmarshalJSON(scanner.Bytes())
-
-		i++
-		isAndroid = false
-		isMSIE = false
-
-		for _, browser := range user.Browsers {
-			if strings.Contains(browser, "Android") {
-				isAndroid = true
-				notSeenBefore = true
-				for _, item := range seenBrowsers {
-					if item == browser {
-						notSeenBefore = false
-					}
-				}
-				if notSeenBefore {
-					seenBrowsers = append(seenBrowsers, browser)
-					uniqueBrowsers++
-				}
-			} else if strings.Contains(browser, "MSIE") {
-				isMSIE = true
-				notSeenBefore = true
-				for _, item := range seenBrowsers {
-					if item == browser {
-						notSeenBefore = false
-					}
-				}
-				if notSeenBefore {
-					seenBrowsers = append(seenBrowsers, browser)
-					uniqueBrowsers++
-				}
-			}
-		}
-
-		if !(isAndroid && isMSIE) {
-			continue
-		}
-
-		email := strings.Replace(user.Email, "@", " [at] ", 1)
-		fmt.Fprintf(out, "[%d] %s <%s>\n", i, user.Name, email)
-
-		//dataPool.Put(user)
+	stats, err := androidMSIE.RunParallel(file, info.Size(), runtime.GOMAXPROCS(0), out)
+	if err != nil {
+		panic(err)
 	}
-
 	fmt.Fprintln(out)
-	fmt.Fprintln(out, "Total unique browsers", len(seenBrowsers))
-}
\ No newline at end of file
+	fmt.Fprintln(out, "Total unique browsers", stats.Distinct["browsers"])
+}
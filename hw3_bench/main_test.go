@@ -2,7 +2,10 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 )
 
@@ -44,3 +47,156 @@ func BenchmarkFast(b *testing.B) {
 		FastSearch(ioutil.Discard)
 	}
 }
+
+func TestQuery(t *testing.T) {
+	lines := `{"name":"Ann","email":"ann@mail.ru","browsers":["Android 4","MSIE 8"],"age":30}
+{"name":"Bob","email":"bob@mail@ru","browsers":["MSIE 9"],"tags":{"a":[1,2]}}
+
+{"name":"Cid","email":null,"browsers":["Android 5","Chrome \"beta\""]}
+{"name":"Dan","browsers":["Android 4","MSIE 9"]}
+`
+	cases := []struct {
+		filter, template string
+		result           string
+		distinct         int
+	}{
+		{`browsers contains "Android" and browsers contains "MSIE"`, "[{#}] {name} <{email|at}>",
+			"[0] Ann <ann [at] mail.ru>\n[4] Dan <>\n", 4},
+		{`(name == "Bob" or email != "ann@mail.ru") and not browsers contains "Chrome"`, "{name}",
+			"Bob\nDan\n", 1},
+		{`name == "Bob"`, "{email|at}",
+			"bob [at] mail [at] ru\n", 0},
+		{`browsers contains "beta"`, "{browsers}!",
+			"Android 5, Chrome \"beta\"!\n", 1},
+	}
+	for _, c := range cases {
+		q, err := Compile(c.filter, c.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := new(bytes.Buffer)
+		stats, err := q.Run(strings.NewReader(lines), out)
+		if err != nil || out.String() != c.result || stats.Distinct["browsers"] != c.distinct || stats.Lines != 4 {
+			t.Errorf("results not match for %s\nGot:\n%v%+v %v\nExpected:\n%v%d distinct", c.filter, out, stats, err, c.result, c.distinct)
+		}
+	}
+
+	_, err := MustCompile(`name == "x"`, "").Run(strings.NewReader(`{"name":1}`), ioutil.Discard)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 0: ") {
+		t.Errorf("expected an error for a number, got %v", err)
+	}
+}
+
+func TestQueryCompile(t *testing.T) {
+	for _, c := range [][2]string{
+		{`browsers contains`, ""},
+		{`browsers has "x"`, ""},
+		{`(name == "x"`, ""},
+		{`name == "x" name`, ""},
+		{`name == x`, ""},
+		{`and == "x"`, ""},
+		{`name == "x`, ""},
+		{`name == "x"`, "{name"},
+		{`name == "x"`, "{name|upper}"},
+		{`name == "x"`, "{a b}"},
+	} {
+		if _, err := Compile(c[0], c[1]); err == nil {
+			t.Errorf("expected an error for %q %q", c[0], c[1])
+		}
+	}
+}
+
+// BenchmarkQuery is a query harder than FastSearch's over the same file
+func BenchmarkQuery(b *testing.B) {
+	q := MustCompile(`(browsers contains "Android" or browsers contains "iPhone") and not email contains ".ru" and name != "Ann"`,
+		"[{#}] {name} <{email|at}> {browsers}")
+	for i := 0; i < b.N; i++ {
+		file, err := os.Open(filePath)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = q.Run(file, ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+		file.Close()
+	}
+}
+
+// BenchmarkFastParallel is the query of FastSearch over users.txt ten times,
+// so RunParallel splits it into chunks and doesn't fall back to Run
+func BenchmarkFastParallel(b *testing.B) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data = bytes.Repeat(append(data, '\n'), 10)
+	if int64(len(data)) <= maxChunk {
+		b.Fatalf("%d bytes are a single chunk", len(data))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err = androidMSIE.RunParallel(bytes.NewReader(data), int64(len(data)), 4, ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestQueryParallel(t *testing.T) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := MustCompile(`browsers contains "Android" or email contains ".ru"`, "[{#}] {name} {#}")
+	expected := new(bytes.Buffer)
+	expectedStats, err := q.Run(bytes.NewReader(data), expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chunkSize := range []int64{1, 1000, 100000, int64(len(data)) * 2} {
+		for _, workers := range []int{1, 3, 8} {
+			out := new(bytes.Buffer)
+			stats, err := q.runChunks(bytes.NewReader(data), int64(len(data)), workers, chunkSize, out)
+			if err != nil || out.String() != expected.String() || fmt.Sprint(stats) != fmt.Sprint(expectedStats) {
+				t.Errorf("results not match for %d bytes chunks and %d workers\nGot: %+v %v\nExpected: %+v", chunkSize, workers, stats, err, expectedStats)
+			}
+		}
+	}
+
+	out := new(bytes.Buffer)
+	stats, err := q.RunParallel(bytes.NewReader(data), int64(len(data)), 4, out)
+	if err != nil || out.String() != expected.String() || fmt.Sprint(stats) != fmt.Sprint(expectedStats) {
+		t.Errorf("results not match for RunParallel\nGot: %+v %v\nExpected: %+v", stats, err, expectedStats)
+	}
+
+	broken := "{}\n{}\r\n\n{]\n{}"
+	_, err = q.runChunks(strings.NewReader(broken), int64(len(broken)), 2, 1, ioutil.Discard)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3: ") {
+		t.Errorf("results not match\nGot: %v\nExpected: line 3: ...", err)
+	}
+}
+
+// TestQueryAllocs checks that the allocations grow with the distinct values
+// and the matched lines, not with the lines: the same file ten times
+// allocates nearly as much as once.
+func TestQueryAllocs(t *testing.T) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := MustCompile(`browsers contains "Android" and browsers contains "MSIE"`, "[{#}] {name} <{email|at}>")
+	allocs := func(data []byte) float64 {
+		return testing.AllocsPerRun(5, func() {
+			if _, err := q.Run(bytes.NewReader(data), ioutil.Discard); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	once := allocs(data)
+	tenTimes := allocs(bytes.Repeat(append(data, '\n'), 10))
+	t.Logf("%v allocs for 1 file, %v for 10", once, tenTimes)
+	if tenTimes > once+20 {
+		t.Errorf("results not match\nGot: %v allocs for 10 files\nExpected: about %v as for 1", tenTimes, once)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+)
+
+const (
+	// minChunk keeps the chunks big enough to be worth passing to a worker.
+	minChunk = 64 * 1024
+	// maxChunk keeps the output of a chunk waiting for the chunks before it
+	// small, a worker streams its chunk whatever the size.
+	maxChunk = 1024 * 1024
+)
+
+// chunk is a part of the input from start to end, it ends after a newline
+// or at the end of the input.
+type chunk struct {
+	start, end int64
+	result     chan *chunkResult
+}
+
+// chunkResult is the output of a chunk with the places of the line numbers
+// left out, they are known only when the chunks before are counted.
+type chunkResult struct {
+	out   []byte
+	marks []lineMark
+	lines int
+	// errLine is the line of err in the chunk
+	err     error
+	errLine int
+}
+
+// RunParallel is Run over size bytes of r split into chunks on newlines,
+// workers chunks are decoded at once. The output is the same as of Run: the
+// lines come in order with their numbers in the whole input, and the values
+// seen by every worker are merged at the end. An input of up to maxChunk,
+// or a single worker, is left to Run: splitting it costs more than the
+// workers save.
+func (q *Query) RunParallel(r io.ReaderAt, size int64, workers int, out io.Writer) (Stats, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	chunkSize := size / int64(workers*4)
+	if chunkSize < minChunk {
+		chunkSize = minChunk
+	}
+	if chunkSize > maxChunk {
+		chunkSize = maxChunk
+	}
+	if workers == 1 || size <= maxChunk {
+		return q.Run(io.NewSectionReader(r, 0, size), out)
+	}
+	return q.runChunks(r, size, workers, chunkSize, out)
+}
+
+func (q *Query) runChunks(r io.ReaderAt, size int64, workers int, chunkSize int64, out io.Writer) (Stats, error) {
+	// a chunk goes to ordered before chunks, so no more than the size of
+	// ordered wait for the output
+	ordered := make(chan *chunk, workers*2)
+	chunks := make(chan *chunk, workers*2)
+	// written results go back to the workers, with their buffers
+	free := make(chan *chunkResult, cap(ordered)+workers)
+	stop := make(chan struct{})
+	var splitErr error
+	go func() {
+		defer close(ordered)
+		defer close(chunks)
+		probe := make([]byte, 4096)
+		for start := int64(0); start < size; {
+			end, err := lineEnd(r, probe, start+chunkSize, size)
+			if err != nil {
+				splitErr = err
+				return
+			}
+			c := &chunk{start: start, end: end, result: make(chan *chunkResult, 1)}
+			select {
+			case ordered <- c:
+			case <-stop:
+				return
+			}
+			chunks <- c
+			start = end
+		}
+	}()
+
+	runners := make([]*runner, workers)
+	wg := &sync.WaitGroup{}
+	for w := range runners {
+		runners[w] = q.newRunner()
+		wg.Add(1)
+		go func(run *runner) {
+			defer wg.Done()
+			scanBuf := scanBuffers.Get().(*[]byte)
+			defer scanBuffers.Put(scanBuf)
+			for c := range chunks {
+				var res *chunkResult
+				select {
+				case res = <-free:
+					*res = chunkResult{out: res.out[:0], marks: res.marks[:0]}
+				default:
+					res = &chunkResult{}
+				}
+				select {
+				case <-stop:
+				default:
+					run.chunk(r, c, scanBuf, res)
+				}
+				c.result <- res
+			}
+		}(runners[w])
+	}
+
+	var err error
+	var buf []byte
+	line := 0
+	for c := range ordered {
+		res := <-c.result
+		if err != nil {
+			continue
+		}
+		if res.err != nil {
+			err = fmt.Errorf("line %d: %v", line+res.errLine, res.err)
+			close(stop)
+			continue
+		}
+
+		buf = buf[:0]
+		prev := 0
+		for _, mark := range res.marks {
+			buf = append(buf, res.out[prev:mark.offset]...)
+			buf = strconv.AppendInt(buf, int64(line+mark.line), 10)
+			prev = mark.offset
+		}
+		buf = append(buf, res.out[prev:]...)
+		line += res.lines
+		free <- res
+		if _, err = out.Write(buf); err != nil {
+			close(stop)
+		}
+	}
+	wg.Wait()
+	if err == nil {
+		err = splitErr
+	}
+
+	for _, other := range runners[1:] {
+		runners[0].merge(other)
+	}
+	return runners[0].result(), err
+}
+
+// chunk scans the lines of the chunk, numbered from 0, into res. The chunk
+// is streamed through buf.
+func (run *runner) chunk(r io.ReaderAt, c *chunk, buf *[]byte, res *chunkResult) {
+	scanner := newScanner(io.NewSectionReader(r, c.start, c.end-c.start), buf)
+	for ; scanner.Scan(); res.lines++ {
+		matched, err := run.scan(scanner.Bytes(), res.lines)
+		if err != nil {
+			res.err, res.errLine = err, res.lines
+			return
+		}
+		if matched {
+			res.out = run.q.appendLine(res.out, &run.rec, &res.marks)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		res.err, res.errLine = err, res.lines
+	}
+}
+
+// lineEnd is the offset after the first newline from pos on, or size if
+// there is none. The input is read by probe.
+func lineEnd(r io.ReaderAt, probe []byte, pos, size int64) (int64, error) {
+	for pos < size {
+		n, err := r.ReadAt(probe, pos)
+		if i := bytes.IndexByte(probe[:n], '\n'); i >= 0 {
+			return pos + int64(i) + 1, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if n == 0 {
+			break
+		}
+		pos += int64(n)
+	}
+	return size, nil
+}
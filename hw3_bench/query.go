@@ -0,0 +1,553 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/mailru/easyjson/jlexer"
+)
+
+// Query is a filter and an output template over JSON lines, one object per
+// line. The filter is made of
+//
+//	field contains "text"   any value of the field has text in it
+//	field == "text"         any value of the field is text
+//	field != "text"         no value of the field is text
+//
+// joined by not, and, or and parentheses. A field is a string or an array
+// of strings, a missing field has no values. The template prints a matched
+// line: {field} is its values joined by ", ", {field|at} replaces every "@"
+// with " [at] " and {#} is the number of the line, from 0.
+type Query struct {
+	filter   expr
+	template []templatePart
+	// fields are all the fields of the filter and the template, the others
+	// are skipped without decoding
+	fields []string
+	index  map[string]int
+	// lazy are the fields of the template only, they are kept raw and
+	// decoded for the matched lines
+	lazy []bool
+	// terms are the contains of the filter, their distinct matched values
+	// are counted in Stats
+	terms []*cmpExpr
+}
+
+// Stats is what Run has seen. Distinct is the number of the distinct values
+// of a field which a contains of the filter has matched, of all lines and
+// not only of the matched ones.
+type Stats struct {
+	Lines    int
+	Matched  int
+	Distinct map[string]int
+}
+
+// record is a decoded line. The values and raw point into the line and are
+// valid until the next one is read.
+type record struct {
+	line   int
+	values [][][]byte
+	raw    [][]byte
+}
+
+type expr interface {
+	match(r *record) bool
+}
+
+type andExpr struct{ left, right expr }
+type orExpr struct{ left, right expr }
+type notExpr struct{ e expr }
+
+type cmpExpr struct {
+	field    int
+	contains bool
+	value    []byte
+}
+
+func (e andExpr) match(r *record) bool { return e.left.match(r) && e.right.match(r) }
+func (e orExpr) match(r *record) bool  { return e.left.match(r) || e.right.match(r) }
+func (e notExpr) match(r *record) bool { return !e.e.match(r) }
+
+func (e *cmpExpr) match(r *record) bool {
+	for _, v := range r.values[e.field] {
+		if e.contains && bytes.Contains(v, e.value) || !e.contains && bytes.Equal(v, e.value) {
+			return true
+		}
+	}
+	return false
+}
+
+type templatePart struct {
+	text  string
+	field int
+	// kind is text, a field or the line number
+	kind   int
+	filter func(dst, v []byte) []byte
+}
+
+const (
+	partText = iota
+	partField
+	partLine
+)
+
+var templateFilters = map[string]func(dst, v []byte) []byte{
+	"at": func(dst, v []byte) []byte {
+		for i := bytes.IndexByte(v, '@'); i >= 0; i = bytes.IndexByte(v, '@') {
+			dst = append(dst, v[:i]...)
+			dst = append(dst, " [at] "...)
+			v = v[i+1:]
+		}
+		return append(dst, v...)
+	},
+}
+
+// Compile parses the filter and the template.
+func Compile(filter, template string) (*Query, error) {
+	q := &Query{index: make(map[string]int)}
+	p := &parser{q: q, tokens: tokenize(filter)}
+	var err error
+	if q.filter, err = p.or(); err != nil {
+		return nil, fmt.Errorf("query %q: %v", filter, err)
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("query %q: unexpected %s", filter, tok)
+	}
+	filterFields := len(q.fields)
+	if q.template, err = q.parseTemplate(template); err != nil {
+		return nil, fmt.Errorf("template %q: %v", template, err)
+	}
+	q.lazy = make([]bool, len(q.fields))
+	for field := filterFields; field < len(q.fields); field++ {
+		q.lazy[field] = true
+	}
+	return q, nil
+}
+
+// MustCompile is Compile which panics on an error.
+func MustCompile(filter, template string) *Query {
+	q, err := Compile(filter, template)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+func (q *Query) field(name string) int {
+	if i, ok := q.index[name]; ok {
+		return i
+	}
+	q.index[name] = len(q.fields)
+	q.fields = append(q.fields, name)
+	return len(q.fields) - 1
+}
+
+// tokenize splits the filter into words, quoted strings, parentheses and
+// operators. A broken quote is left as it is for the parser to report.
+func tokenize(s string) []string {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, s[i:i+1])
+			i++
+		case c == '"':
+			j := i + 1
+			for j < len(s) && s[j] != '"' {
+				if s[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j < len(s) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		case (c == '=' || c == '!') && i+1 < len(s) && s[i+1] == '=':
+			tokens = append(tokens, s[i:i+2])
+			i += 2
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n()\"=!", rune(s[j])) {
+				j++
+			}
+			if j == i {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+type parser struct {
+	q      *Query
+	tokens []string
+}
+
+func (p *parser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *parser) next() string {
+	tok := p.peek()
+	if len(p.tokens) > 0 {
+		p.tokens = p.tokens[1:]
+	}
+	return tok
+}
+
+func (p *parser) or() (expr, error) {
+	left, err := p.and()
+	for err == nil && p.peek() == "or" {
+		p.next()
+		var right expr
+		if right, err = p.and(); err == nil {
+			left = orExpr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) and() (expr, error) {
+	left, err := p.not()
+	for err == nil && p.peek() == "and" {
+		p.next()
+		var right expr
+		if right, err = p.not(); err == nil {
+			left = andExpr{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) not() (expr, error) {
+	if p.peek() == "not" {
+		p.next()
+		e, err := p.not()
+		return notExpr{e}, err
+	}
+	return p.term()
+}
+
+func (p *parser) term() (expr, error) {
+	tok := p.next()
+	switch tok {
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	case "(":
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if tok = p.next(); tok != ")" {
+			return nil, fmt.Errorf("expected ), got %q", tok)
+		}
+		return e, nil
+	}
+	if !isField(tok) {
+		return nil, fmt.Errorf("expected a field, got %q", tok)
+	}
+
+	op := p.next()
+	if op != "contains" && op != "==" && op != "!=" {
+		return nil, fmt.Errorf("expected contains, == or != after %s, got %q", tok, op)
+	}
+	raw := p.next()
+	value, err := strconv.Unquote(raw)
+	if err != nil || !strings.HasPrefix(raw, `"`) {
+		return nil, fmt.Errorf("expected a quoted string after %s %s, got %q", tok, op, raw)
+	}
+
+	cmp := &cmpExpr{field: p.q.field(tok), contains: op == "contains", value: []byte(value)}
+	switch op {
+	case "contains":
+		p.q.terms = append(p.q.terms, cmp)
+	case "!=":
+		return notExpr{cmp}, nil
+	}
+	return cmp, nil
+}
+
+func isField(s string) bool {
+	if s == "and" || s == "or" || s == "not" || s == "contains" {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' && r != '.' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func (q *Query) parseTemplate(s string) ([]templatePart, error) {
+	var parts []templatePart
+	for s != "" {
+		open := strings.IndexByte(s, '{')
+		if open < 0 {
+			parts = append(parts, templatePart{kind: partText, text: s})
+			break
+		}
+		if open > 0 {
+			parts = append(parts, templatePart{kind: partText, text: s[:open]})
+		}
+		end := strings.IndexByte(s[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed {")
+		}
+		name := s[open+1 : open+end]
+		s = s[open+end+1:]
+
+		part := templatePart{kind: partField}
+		if i := strings.IndexByte(name, '|'); i >= 0 {
+			filter, ok := templateFilters[name[i+1:]]
+			if !ok {
+				return nil, fmt.Errorf("unknown filter %q", name[i+1:])
+			}
+			name, part.filter = name[:i], filter
+		}
+		switch {
+		case name == "#":
+			part.kind = partLine
+		case isField(name):
+			part.field = q.field(name)
+		default:
+			return nil, fmt.Errorf("bad field %q", name)
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+// maxLine is the longest line a query reads.
+const maxLine = 16 * 1024 * 1024
+
+// scanBuffers are the buffers of the scanners of lines, they are reused
+// between the runs.
+var scanBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 64*1024)
+		return &buf
+	},
+}
+
+// newScanner scans the lines of r in buf, which grows only for a line
+// longer than it.
+func newScanner(r io.Reader, buf *[]byte) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(*buf, maxLine)
+	return scanner
+}
+
+// Run reads the lines of r in one pass and writes the template of every
+// matched line to out. A line is decoded into the values of the fields of
+// the query only, which point into the line, so the allocations don't grow
+// with the number of lines but with the number of distinct values.
+func (q *Query) Run(r io.Reader, out io.Writer) (Stats, error) {
+	run := q.newRunner()
+	// enough for a line of the template, it grows for a longer one
+	buf := make([]byte, 0, 256)
+
+	scanBuf := scanBuffers.Get().(*[]byte)
+	defer scanBuffers.Put(scanBuf)
+	scanner := newScanner(r, scanBuf)
+	for n := 0; scanner.Scan(); n++ {
+		matched, err := run.scan(scanner.Bytes(), n)
+		if err != nil {
+			return run.result(), fmt.Errorf("line %d: %v", n, err)
+		}
+		if !matched {
+			continue
+		}
+		buf = q.appendLine(buf[:0], &run.rec, nil)
+		if _, err = out.Write(buf); err != nil {
+			return run.result(), err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return run.result(), err
+	}
+	return run.result(), nil
+}
+
+// runner is the state of a scan, a parallel one has a runner per worker.
+type runner struct {
+	q     *Query
+	stats Stats
+	// seen are the matched values by field
+	seen  []map[string]struct{}
+	rec   record
+	lexer jlexer.Lexer
+}
+
+func (q *Query) newRunner() *runner {
+	r := &runner{
+		q:    q,
+		seen: make([]map[string]struct{}, len(q.fields)),
+		rec: record{
+			values: make([][][]byte, len(q.fields)),
+			raw:    make([][]byte, len(q.fields)),
+		},
+	}
+	for _, term := range q.terms {
+		if r.seen[term.field] == nil {
+			r.seen[term.field] = make(map[string]struct{})
+		}
+	}
+	return r
+}
+
+// scan decodes the line n and tells if the filter matches it. The values
+// of the contains are recorded either way. An empty line is skipped.
+func (r *runner) scan(line []byte, n int) (bool, error) {
+	if len(line) == 0 {
+		return false, nil
+	}
+	r.rec.line = n
+	r.stats.Lines++
+	if err := r.q.decode(&r.lexer, line, &r.rec); err != nil {
+		return false, err
+	}
+
+	for _, term := range r.q.terms {
+		for _, v := range r.rec.values[term.field] {
+			// only a new value is copied, the lookup doesn't allocate
+			if _, ok := r.seen[term.field][string(v)]; !ok && bytes.Contains(v, term.value) {
+				r.seen[term.field][string(v)] = struct{}{}
+			}
+		}
+	}
+
+	if !r.q.filter.match(&r.rec) {
+		return false, nil
+	}
+	for field, raw := range r.rec.raw {
+		if raw == nil {
+			continue
+		}
+		r.lexer = jlexer.Lexer{Data: raw}
+		r.rec.values[field] = decodeValues(&r.lexer, r.rec.values[field])
+		if err := r.lexer.Error(); err != nil {
+			return false, err
+		}
+	}
+	r.stats.Matched++
+	return true, nil
+}
+
+// merge adds what other has seen.
+func (r *runner) merge(other *runner) {
+	r.stats.Lines += other.stats.Lines
+	r.stats.Matched += other.stats.Matched
+	for field, values := range other.seen {
+		for v := range values {
+			r.seen[field][v] = struct{}{}
+		}
+	}
+}
+
+func (r *runner) result() Stats {
+	stats := r.stats
+	stats.Distinct = make(map[string]int)
+	for field, values := range r.seen {
+		if values != nil {
+			stats.Distinct[r.q.fields[field]] = len(values)
+		}
+	}
+	return stats
+}
+
+// decode reads the fields of the filter from the line, in place. The
+// fields of the template are only found, there is no need to decode them
+// unless the line matches.
+func (q *Query) decode(in *jlexer.Lexer, line []byte, rec *record) error {
+	for i := range rec.values {
+		rec.values[i] = rec.values[i][:0]
+		rec.raw[i] = nil
+	}
+	*in = jlexer.Lexer{Data: line}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeBytes()
+		in.WantColon()
+		field, ok := q.index[string(key)]
+		switch {
+		case !ok || in.IsNull():
+			in.SkipRecursive()
+		case q.lazy[field]:
+			rec.raw[field] = in.Raw()
+		default:
+			rec.values[field] = decodeValues(in, rec.values[field])
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	in.Consumed()
+	return in.Error()
+}
+
+// decodeValues appends a string or the strings of an array as they are in
+// the input, only an escaped string is copied.
+func decodeValues(in *jlexer.Lexer, values [][]byte) [][]byte {
+	if !in.IsDelim('[') {
+		return append(values, in.UnsafeBytes())
+	}
+	in.Delim('[')
+	for !in.IsDelim(']') {
+		values = append(values, in.UnsafeBytes())
+		in.WantComma()
+	}
+	in.Delim(']')
+	return values
+}
+
+// lineMark is a place in the output of a chunk where the line number goes,
+// line is counted from the start of the chunk.
+type lineMark struct {
+	offset int
+	line   int
+}
+
+// appendLine prints the template of the record. With marks the line number
+// is left out and its place is added to marks instead.
+func (q *Query) appendLine(dst []byte, rec *record, marks *[]lineMark) []byte {
+	for _, part := range q.template {
+		switch part.kind {
+		case partText:
+			dst = append(dst, part.text...)
+		case partLine:
+			if marks != nil {
+				*marks = append(*marks, lineMark{len(dst), rec.line})
+			} else {
+				dst = strconv.AppendInt(dst, int64(rec.line), 10)
+			}
+		case partField:
+			for i, v := range rec.values[part.field] {
+				if i > 0 {
+					dst = append(dst, ", "...)
+				}
+				if part.filter != nil {
+					dst = part.filter(dst, v)
+				} else {
+					dst = append(dst, v...)
+				}
+			}
+		}
+	}
+	return append(dst, '\n')
+}